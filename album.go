@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Telegram sends between 2 and 10 files as one media group.
+const (
+	albumMinItems = 2
+	albumMaxItems = 10
+)
+
+// albumRequestedTypes expands the type fields of an album request to one
+// media type per file: none means auto for all files, a single one applies
+// to all files, otherwise there has to be one per file.
+func albumRequestedTypes(types []string, count int) ([]string, error) {
+	requested := make([]string, count)
+	for i := range requested {
+		switch {
+		case len(types) == 0:
+			requested[i] = mediaAuto
+		case len(types) == 1:
+			requested[i] = types[0]
+		case len(types) == count:
+			requested[i] = types[i]
+		default:
+			return nil, fmt.Errorf("got %d types for %d files, send one type for all files or one per file", len(types), count)
+		}
+		if requested[i] == "" {
+			requested[i] = mediaAuto
+		}
+		if !isValidMediaType(requested[i]) {
+			return nil, fmt.Errorf("invalid type %q for file %d, must be auto, document, photo, video or audio", requested[i], i+1)
+		}
+	}
+	return requested, nil
+}
+
+// resolveAlbumTypes picks the media type of every file of an album from the
+// requested and the detected types. If the detected types cannot be grouped,
+// the files of type auto are sent as documents.
+func resolveAlbumTypes(requested []string, detected []string) ([]string, error) {
+	types := make([]string, len(requested))
+	auto := false
+	for i, mediaType := range requested {
+		if mediaType != mediaAuto {
+			types[i] = mediaType
+			continue
+		}
+		auto = true
+		switch detected[i] {
+		case mediaAnimation, mediaVoice:
+			types[i] = mediaDocument
+		default:
+			types[i] = detected[i]
+		}
+	}
+	err := checkAlbum(types)
+	if err != nil && auto {
+		for i, mediaType := range requested {
+			if mediaType == mediaAuto {
+				types[i] = mediaDocument
+			}
+		}
+		err = checkAlbum(types)
+	}
+	return types, err
+}
+
+// albumGroup names the kinds of media that may share an album.
+func albumGroup(mediaType string) string {
+	if mediaType == mediaPhoto || mediaType == mediaVideo {
+		return "photo or video"
+	}
+	return mediaType
+}
+
+// checkAlbum applies Telegram's rules for media groups: photos and videos
+// can be mixed, documents and audio files can only be grouped with their
+// own kind, and animations and voice messages cannot be part of an album.
+func checkAlbum(types []string) error {
+	for i, mediaType := range types {
+		if mediaType == mediaAnimation || mediaType == mediaVoice {
+			return fmt.Errorf("file %d is sent as %s, which cannot be part of an album", i+1, mediaType)
+		}
+	}
+	for i, mediaType := range types {
+		if albumGroup(mediaType) != albumGroup(types[0]) {
+			return fmt.Errorf("file %d (%s) cannot be grouped with file 1 (%s): photos and videos can be mixed, but documents and audio files can only be grouped with their own kind", i+1, mediaType, types[0])
+		}
+	}
+	return nil
+}
+
+// newInputMedia builds one item of a media group.
+func newInputMedia(mediaType string, file tgbotapi.RequestFileData, caption string) interface{} {
+	switch mediaType {
+	case mediaPhoto:
+		photo := tgbotapi.NewInputMediaPhoto(file)
+		photo.Caption = caption
+		return photo
+	case mediaVideo:
+		video := tgbotapi.NewInputMediaVideo(file)
+		video.Caption = caption
+		video.SupportsStreaming = true
+		return video
+	case mediaAudio:
+		audio := tgbotapi.NewInputMediaAudio(file)
+		audio.Caption = caption
+		return audio
+	default:
+		document := tgbotapi.NewInputMediaDocument(file)
+		document.Caption = caption
+		return document
+	}
+}
+
+// albumCaptionError reports the first caption that is too long to be
+// attached to its file.
+func albumCaptionError(captions []string) error {
+	for i, caption := range captions {
+		if utf16Length(caption) > telegramCaptionLimit {
+			return fmt.Errorf("caption of file %d is longer than %d characters", i+1, telegramCaptionLimit)
+		}
+	}
+	return nil
+}
+
+func capitalize(text string) string {
+	if text == "" {
+		return text
+	}
+	return strings.ToUpper(text[:1]) + text[1:]
+}
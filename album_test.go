@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAlbumRequestedTypes(t *testing.T) {
+	tests := []struct {
+		types   []string
+		count   int
+		want    []string
+		wantErr bool
+	}{
+		{nil, 2, []string{mediaAuto, mediaAuto}, false},
+		{[]string{mediaPhoto}, 3, []string{mediaPhoto, mediaPhoto, mediaPhoto}, false},
+		{[]string{mediaPhoto, ""}, 2, []string{mediaPhoto, mediaAuto}, false},
+		{[]string{mediaPhoto, mediaVideo}, 3, nil, true},
+		{[]string{"sticker"}, 2, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := albumRequestedTypes(tt.types, tt.count)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("albumRequestedTypes(%q, %d) = %q, %v, want %q, error %v", tt.types, tt.count, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestResolveAlbumTypes(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		detected  []string
+		want      []string
+		wantErr   string
+	}{
+		{
+			name:      "photos and videos",
+			requested: []string{mediaAuto, mediaAuto},
+			detected:  []string{mediaPhoto, mediaVideo},
+			want:      []string{mediaPhoto, mediaVideo},
+		},
+		{
+			name:      "mixed detected types become documents",
+			requested: []string{mediaAuto, mediaAuto},
+			detected:  []string{mediaPhoto, mediaDocument},
+			want:      []string{mediaDocument, mediaDocument},
+		},
+		{
+			name:      "animations are not grouped",
+			requested: []string{mediaAuto, mediaAuto},
+			detected:  []string{mediaAnimation, mediaDocument},
+			want:      []string{mediaDocument, mediaDocument},
+		},
+		{
+			name:      "audio",
+			requested: []string{mediaAudio, mediaAuto},
+			detected:  []string{mediaAudio, mediaAudio},
+			want:      []string{mediaAudio, mediaAudio},
+		},
+		{
+			name:      "requested types that cannot be grouped",
+			requested: []string{mediaPhoto, mediaAudio},
+			detected:  []string{mediaPhoto, mediaAudio},
+			wantErr:   "file 2 (audio) cannot be grouped with file 1 (photo)",
+		},
+		{
+			name:      "requested voice",
+			requested: []string{mediaVoice, mediaVoice},
+			detected:  []string{mediaVoice, mediaVoice},
+			wantErr:   "file 1 is sent as voice, which cannot be part of an album",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveAlbumTypes(tt.requested, tt.detected)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveAlbumTypes() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveAlbumTypes() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnqueueAlbum(t *testing.T) {
+	openTestDB(t)
+	delivery := Delivery{ChatID: 1, Kind: deliveryKindAlbum, Items: []AlbumItem{
+		{Position: 0, FileName: "a.png", MediaType: mediaPhoto},
+		{Position: 1, FileName: "b.png", MediaType: mediaPhoto},
+	}}
+	if err := enqueueDelivery(&delivery); err != nil {
+		t.Fatal(err)
+	}
+	var items []AlbumItem
+	db.Where("delivery_id = ?", delivery.ID).Order("position").Find(&items)
+	if len(items) != 2 || items[1].FileName != "b.png" {
+		t.Errorf("stored album items = %+v", items)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// maxBatchSize is the most messages a batch may hold.
+const maxBatchSize = 100
+
+// deliveryRejected is the status of a message of a batch that was not
+// queued, e.g. because it is invalid.
+const deliveryRejected = "rejected"
+
+// BatchResult reports one message of a batch: its delivery, or why it was
+// not queued.
+type BatchResult struct {
+	Index      int    `json:"index"`
+	DeliveryID string `json:"delivery_id,omitempty"`
+	Status     string `json:"status"`
+	MessageID  int    `json:"message_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Duplicate messages were queued before with the same dedup_key.
+	Duplicate bool `json:"duplicate,omitempty"`
+	// Grouped messages repeat an earlier one with the same group_key.
+	Grouped bool `json:"grouped,omitempty"`
+
+	// httpStatus is what a request with only this message is answered with.
+	httpStatus int
+}
+
+// queueBatch queues the messages of a batch in order. Messages that cannot
+// be queued are reported and skipped; the others are queued regardless.
+// Messages with a dedup_key that was used before report the original
+// delivery.
+func queueBatch(realIP string, subscription *Subscription, messages []Message) ([]BatchResult, []Delivery) {
+	results := make([]BatchResult, len(messages))
+	deliveries := make([]Delivery, len(messages))
+	for i := range messages {
+		results[i].Index = i
+		delivery, outcome, err := enqueueMessage(realIP, subscription, &messages[i], messages[i].DedupKey)
+		if err != nil {
+			results[i].httpStatus = err.(*sendError).status
+			results[i].Status = deliveryRejected
+			results[i].Error = err.Error()
+			continue
+		}
+		deliveries[i] = delivery
+		results[i].DeliveryID = delivery.UUID
+		results[i].Status = delivery.Status
+		results[i].Duplicate = outcome == outcomeReplayed
+		results[i].Grouped = outcome == outcomeGrouped
+		results[i].httpStatus = http.StatusOK
+	}
+	return results, deliveries
+}
+
+// waitForBatch waits, within a single timeout, for the queued messages of a
+// batch to be sent or to fail, and adds their state to results.
+func waitForBatch(results []BatchResult, deliveries []Delivery, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for i, delivery := range deliveries {
+		if delivery.ID == 0 {
+			continue
+		}
+		waited := waitForDelivery(delivery.ID, time.Until(deadline))
+		results[i].Status = waited.Status
+		results[i].MessageID = waited.TelegramMessageID
+		results[i].Error = waited.LastError
+	}
+}
+
+// handleBatch queues a JSON array of messages, each with the fields of
+// /api/:uuid/json. The answer reports every message; it is 200 as long as
+// any of them was queued, otherwise it has the status of the first error.
+func handleBatch(c *gin.Context) {
+	realIP := getRealIP(c)
+	logger.Debug("Received batch from " + realIP)
+	subscription, err := checkAuthorization(c)
+	if err != nil {
+		respondAuthorizationError(c, realIP, err)
+		return
+	}
+	var messages []Message
+	if err := c.ShouldBindJSON(&messages); err != nil {
+		logger.Error("Invalid JSON from "+realIP, zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid JSON, expected an array of messages",
+		})
+		return
+	}
+	if len(messages) == 0 || len(messages) > maxBatchSize {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "A batch must hold 1 to " + strconv.Itoa(maxBatchSize) + " messages",
+		})
+		return
+	}
+	results, deliveries := queueBatch(realIP, subscription, messages)
+	queued := 0
+	for _, result := range results {
+		if result.DeliveryID != "" {
+			queued++
+		}
+	}
+	if wait, _ := strconv.ParseBool(c.Query("wait")); wait {
+		waitForBatch(results, deliveries, deliveryWaitTimeout)
+	}
+	status := http.StatusOK
+	if queued == 0 {
+		status = results[0].httpStatus
+	}
+	c.JSON(status, gin.H{
+		"message": fmt.Sprintf("%d of %d messages queued", queued, len(messages)),
+		"results": results,
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	openTestDB(t)
+	db.Create(&Subscription{ChatID: 1, UUID: "u1", ReceiveMsgs: true, ThreadID: 5})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w, _ := serveTest(handleBatch, http.MethodPost, "/api/:uuid/batch", "/api/u1/batch", body, nil)
+		return w
+	}
+
+	w := post(`[{"msg": "first", "format": "markdown"}, {"msg": ""}, {"msg": "third", "format": "html", "thread_id": 7}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch answered %d: %s", w.Code, w.Body)
+	}
+	var report struct {
+		Results []BatchResult `json:"results"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if len(report.Results) != 3 || report.Results[0].Status != deliveryQueued || report.Results[1].Status != deliveryRejected || report.Results[1].Error == "" || report.Results[2].Index != 2 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	var deliveries []Delivery
+	db.Order("id").Find(&deliveries)
+	if len(deliveries) != 2 || deliveries[0].UUID != report.Results[0].DeliveryID || deliveries[1].UUID != report.Results[2].DeliveryID {
+		t.Fatalf("deliveries = %+v", deliveries)
+	}
+	if deliveries[0].ThreadID != 5 || deliveries[1].ThreadID != 7 || deliveries[1].Format != "html" {
+		t.Errorf("deliveries lost their options: %+v", deliveries)
+	}
+
+	if w := post(`[{"msg": ""}]`); w.Code != http.StatusBadRequest {
+		t.Errorf("batch without valid messages answered %d", w.Code)
+	}
+	if w := post(`[]`); w.Code != http.StatusBadRequest {
+		t.Errorf("empty batch answered %d", w.Code)
+	}
+	if w := post(`{"msg": "not an array"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("single message answered %d", w.Code)
+	}
+}
@@ -2,10 +2,9 @@ package main
 
 import (
 	"fmt"
-	"io"
-	"mime/multipart"
 	"strconv"
 	"strings"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/google/uuid"
@@ -27,8 +26,23 @@ func initBot(token string, url string) {
 		{Command: "start", Description: "Start the bot"},
 		{Command: "subscribe", Description: "Subscribe to receive messages"},
 		{Command: "unsubscribe", Description: "Unsubscribe from receiving messages"},
-		{Command: "regenerate", Description: "Regenerate UUID and AES key"},
+		{Command: "regenerate", Description: "Regenerate UUID and AES key: [now]"},
 		{Command: "info", Description: "Get your chat ID, UUID and AES key"},
+		{Command: "signing", Description: "Require signed requests: on, off, secret or reset"},
+		{Command: "token_new", Description: "Create an API token: <label> [expiry]"},
+		{Command: "tokens", Description: "List your API tokens"},
+		{Command: "token_revoke", Description: "Revoke an API token: <id>"},
+		{Command: "reply_webhook", Description: "Forward replies to notifications: [url|off]"},
+		{Command: "topic_new", Description: "Create a topic to notify many chats at once: <name> [approval]"},
+		{Command: "topics", Description: "List your topics and their members"},
+		{Command: "topic_token", Description: "Replace the publish token of your topic: <name>"},
+		{Command: "topic_delete", Description: "Delete your topic: <name>"},
+		{Command: "join", Description: "Join a topic: <topic>"},
+		{Command: "leave", Description: "Leave a topic: <topic>"},
+		{Command: "approve", Description: "Approve a chat that asked to join your topic: <topic> <chat ID>"},
+		{Command: "reject", Description: "Reject or remove a member of your topic: <topic> <chat ID>"},
+		{Command: "quiet", Description: "Set quiet hours: <HH:MM-HH:MM> [time zone] [silent|digest], or off"},
+		{Command: "scheduled", Description: "List or cancel scheduled messages: [cancel <ID>]"},
 		{Command: "help", Description: "Get help"},
 		{Command: "version", Description: "Get version"},
 	}...)
@@ -36,63 +50,122 @@ func initBot(token string, url string) {
 	logger.Info("Telegram bot commands set")
 }
 
-func sendMarkdownV2(chatID int64, text string) {
-	text = escapeMarkdownV2(text)
+// send hands c to Telegram once the rate limiter allows another message to
+// chatID. Flood control errors pause the chat for the requested time.
+func send(chatID int64, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	limiter.wait(chatID)
+	sent, err := bot.Send(c)
+	if wait := retryAfter(err); wait > 0 {
+		limiter.pause(chatID, wait)
+	}
+	return sent, err
+}
+
+// request is send for the calls that Telegram answers without a message,
+// such as deleting one.
+func request(chatID int64, c tgbotapi.Chattable) error {
+	limiter.wait(chatID)
+	_, err := bot.Request(c)
+	if wait := retryAfter(err); wait > 0 {
+		limiter.pause(chatID, wait)
+	}
+	return err
+}
+
+func sendMarkdownV2(chatID int64, text string) (tgbotapi.Message, error) {
+	text = markdownToMarkdownV2(text)
 	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ParseMode = tgbotapi.ModeMarkdownV2
-	bot.Send(msg)
+	return send(chatID, msg)
 }
 
-func sendText(chatID int64, text string) {
+func sendText(chatID int64, text string) (tgbotapi.Message, error) {
 	msg := tgbotapi.NewMessage(chatID, text)
-	bot.Send(msg)
+	return send(chatID, msg)
 }
 
-func sendInAppHTML(chatID int64, text string) {
+func sendInAppHTML(chatID int64, text string) (tgbotapi.Message, error) {
 	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ParseMode = tgbotapi.ModeHTML
-	bot.Send(msg)
+	return send(chatID, msg)
 }
 
-func sendServerHTML(chatID int64, text string) {
+// saveArticle stores text as a page rendered by this server and returns its
+// URL. Saving the same id again returns the existing page.
+func saveArticle(id string, text string) (string, error) {
 	var article Article
-	article.UUID = uuid.New().String()
-	article.MarkdownText = text
-	article_db.Create(&article)
-	msg := config.PostURL + "/html/" + article.UUID
-	sendText(chatID, msg)
+	if err := article_db.Where(Article{UUID: id}).Attrs(Article{MarkdownText: text}).FirstOrCreate(&article).Error; err != nil {
+		logger.Error("Failed to save article", zap.Error(err))
+		return "", err
+	}
+	return config.PostURL + "/html/" + article.UUID, nil
 }
 
-func sendWithFormat(chatID int64, text string, format string) {
-	logger.Debug("Sending format", zap.String("format", format), zap.String("text", text), zap.Int64("chatID", chatID))
-	format = strings.ToLower(format)
-	if format == "markdown" {
-		sendMarkdownV2(chatID, text)
-	} else if format == "in-app-html" {
-		sendInAppHTML(chatID, text)
-	} else if format == "server-html" {
-		sendServerHTML(chatID, text)
-	} else {
-		sendText(chatID, text)
+// renderMessage turns text into the messages that show it in format and
+// returns them together with their parse mode. Text that does not fit into
+// a single message is handled as overflow asks; articleID names the page
+// used by the server-html format and overflow.
+func renderMessage(text string, format string, overflow string, articleID string) ([]string, string, error) {
+	logger.Debug("Rendering format", zap.String("format", format), zap.String("overflow", overflow), zap.String("text", text))
+	rendered := text
+	parseMode := ""
+	switch strings.ToLower(format) {
+	case "markdown":
+		rendered = markdownToMarkdownV2(text)
+		parseMode = tgbotapi.ModeMarkdownV2
+	case "in-app-html":
+		parseMode = tgbotapi.ModeHTML
+	case "server-html":
+		link, err := saveArticle(articleID, text)
+		return []string{link}, "", err
+	}
+	if utf16Length(rendered) <= telegramMessageLimit {
+		return []string{rendered}, parseMode, nil
+	}
+	switch overflow {
+	case overflowServerHTML:
+		link, err := saveArticle(articleID, text)
+		return []string{link}, "", err
+	case overflowTruncate:
+		parts := splitMessage(rendered, parseMode, telegramMessageLimit-1)
+		return []string{parts[0] + "…"}, parseMode, nil
+	default:
+		return splitMessage(rendered, parseMode, telegramMessageLimit), parseMode, nil
 	}
 }
 
-func sendFile(chatID int64, file *multipart.FileHeader, caption string) error {
-	fileBytes, err := file.Open()
-	if err != nil {
-		return err
+// sendFile uploads a spooled file as mediaType, or as the type detected from
+// its MIME type for mediaAuto, with the caption attached. The file is
+// streamed from disk rather than read into memory. A detected type that
+// Telegram rejects, e.g. a photo with odd dimensions, is sent as a document.
+func sendFile(chatID int64, path string, name string, mediaType string, caption string, options sendOptions) (tgbotapi.Message, error) {
+	sendAs := mediaType
+	switch sendAs {
+	case mediaAuto:
+		sendAs = detectMediaType(name, path)
+	case "":
+		sendAs = mediaDocument
+	}
+	// A caption longer than Telegram allows follows the file as a message.
+	attached := caption
+	if utf16Length(caption) > telegramCaptionLimit {
+		attached = ""
+	}
+	logger.Debug("Sending file: "+name, zap.String("type", sendAs))
+	sent, err := uploadFile(chatID, path, name, sendAs, attached, options)
+	if err != nil && mediaType == mediaAuto && sendAs != mediaDocument && isPermanentSendError(err) {
+		logger.Info("Sending file as document after Telegram rejected it as "+sendAs, zap.Error(err))
+		sent, err = uploadFile(chatID, path, name, mediaDocument, attached, options)
 	}
-	logger.Debug("Received file: " + file.Filename + " with size: " + strconv.FormatInt(file.Size, 10))
-	doc := tgbotapi.FileBytes{Name: file.Filename}
-	content, err := io.ReadAll(fileBytes)
 	if err != nil {
-		logger.Error("Failed to read file", zap.Error(err))
-		return err
+		return sent, err
+	}
+	if attached != caption {
+		if _, err := sendMessage(chatID, caption, "", nil, options.followUp()); err != nil {
+			logger.Error("Failed to send file caption", zap.Error(err))
+		}
 	}
-	doc.Bytes = content
-	bot.Send(tgbotapi.NewDocument(chatID, doc))
-	sendText(chatID, caption)
-	return nil
+	return sent, nil
 }
 
 func getChatInformation(chatID int64) (*tgbotapi.Chat, error) {
@@ -108,7 +181,9 @@ func getChatInformation(chatID int64) (*tgbotapi.Chat, error) {
 	return &chat, nil
 }
 
-func handleSubscribe(chatID int64, managerID int64) {
+// handleSubscribe subscribes chatID. Subscribing from a forum topic of the
+// chat makes it the topic notifications go to by default.
+func handleSubscribe(chatID int64, managerID int64, threadID int) {
 	chat, err := getChatInformation(chatID)
 	if err != nil {
 		logger.Error("Failed to get chat information", zap.Error(err))
@@ -118,11 +193,15 @@ func handleSubscribe(chatID int64, managerID int64) {
 	logger.Info("Received subscribe request", zap.Int64("chatID", chatID))
 	var subscription Subscription
 	db.First(&subscription, "chat_id = ?", chatID)
+	if chatID != managerID {
+		threadID = subscription.ThreadID
+	}
 	if subscription.UUID != "" {
 		subscription.ReceiveMsgs = true
 		subscription.UserName = chat.UserName
 		subscription.NickName = chat.FirstName + " " + chat.LastName
-		db.Save(&subscription)
+		subscription.ThreadID = threadID
+		saveSubscription(&subscription)
 		subscripedText := ""
 		subscripedText += "You are already subscribed\n\n"
 		subscripedText += "Your chat ID: `" + strconv.FormatInt(chatID, 10) + "`\n\n"
@@ -130,6 +209,9 @@ func handleSubscribe(chatID int64, managerID int64) {
 		subscripedText += "Your nickname: `" + subscription.NickName + "`\n\n"
 		subscripedText += "Your UUID: `" + subscription.UUID + "`\n\n"
 		subscripedText += "Your AES key: `" + subscription.AESKey + "`\n\n"
+		if threadID != 0 {
+			subscripedText += "Notifications go to the topic you subscribed from\n\n"
+		}
 		sendMarkdownV2(managerID, subscripedText)
 		return
 	}
@@ -143,7 +225,7 @@ func handleSubscribe(chatID int64, managerID int64) {
 	}
 	userName := chat.UserName
 	nickName := chat.FirstName + " " + chat.LastName
-	db.Create(&Subscription{UUID: uuidStr, ChatID: chatID, ReceiveMsgs: true, AESKey: aesKey, UserName: userName, NickName: nickName})
+	db.Create(&Subscription{UUID: uuidStr, ChatID: chatID, ReceiveMsgs: true, AESKey: aesKey, UserName: userName, NickName: nickName, ThreadID: threadID})
 	subscripedText := ""
 	subscripedText += "Subscribed\n\n"
 	subscripedText += "Your chat ID: `" + strconv.FormatInt(chatID, 10) + "`\n\n"
@@ -151,10 +233,23 @@ func handleSubscribe(chatID int64, managerID int64) {
 	subscripedText += "Your nickname: `" + nickName + "`\n\n"
 	subscripedText += "Your UUID: `" + uuidStr + "`\n\n"
 	subscripedText += "Your AES key: `" + aesKey + "`\n\n"
+	if threadID != 0 {
+		subscripedText += "Notifications go to the topic you subscribed from\n\n"
+	}
 	sendMarkdownV2(managerID, subscripedText)
 }
 
-func handleRegenerate(chatID int64, managerID int64) {
+// handleRegenerate replaces the UUID and AES key of chatID. The replaced
+// ones keep working for the configured grace period, unless args is "now".
+func handleRegenerate(chatID int64, managerID int64, args []string) {
+	grace := config.RegenerateGrace
+	if len(args) > 0 {
+		if len(args) != 1 || strings.ToLower(args[0]) != "now" {
+			bot.Send(tgbotapi.NewMessage(managerID, "Usage: /regenerate [now]"))
+			return
+		}
+		grace = 0
+	}
 	chat, err := getChatInformation(chatID)
 	if err != nil {
 		logger.Error("Failed to get chat information", zap.Error(err))
@@ -172,14 +267,32 @@ func handleRegenerate(chatID int64, managerID int64) {
 	var subscription Subscription
 	db.First(&subscription, "chat_id = ?", chatID)
 	if subscription.UUID != "" {
-		subscription.UUID = uuidStr
-		subscription.AESKey = aesKey
+		rotateCredentials(&subscription, uuidStr, aesKey, grace, managerID)
 		subscription.NickName = chat.FirstName + " " + chat.LastName
 		subscription.UserName = chat.UserName
-		db.Save(&subscription)
+		if subscription.SigningSecret != "" {
+			if subscription.SigningSecret, err = generateRandomAESKey(); err != nil {
+				logger.Error("Failed to generate signing secret", zap.Error(err))
+				bot.Send(tgbotapi.NewMessage(managerID, "Failed to generate signing secret"))
+				return
+			}
+		}
+		if err := saveSubscription(&subscription); err != nil {
+			logger.Error("Failed to save regenerated credentials", zap.Error(err))
+			bot.Send(tgbotapi.NewMessage(managerID, "Failed to save regenerated credentials"))
+			return
+		}
 		subscriptionText := "Regenerated\n\n"
 		subscriptionText += "Your UUID: `" + uuidStr + "`\n\n"
 		subscriptionText += "Your AES key: `" + aesKey + "`\n\n"
+		if subscription.SigningSecret != "" {
+			subscriptionText += "Your signing secret: `" + subscription.SigningSecret + "`\n\n"
+		}
+		if subscription.PreviousExpiresAt != nil {
+			subscriptionText += "The previous UUID and AES key keep working until " + subscription.PreviousExpiresAt.UTC().Format(time.RFC3339) + "; messages sent with them carry a warning. Use `/regenerate now` to revoke them at once."
+		} else {
+			subscriptionText += "The previous UUID and AES key no longer work."
+		}
 		sendMarkdownV2(managerID, subscriptionText)
 	} else {
 		db.Create(&Subscription{UUID: uuidStr, ChatID: chatID, ReceiveMsgs: true, AESKey: aesKey, UserName: chat.UserName, NickName: chat.FirstName + " " + chat.LastName})
@@ -195,7 +308,7 @@ func handleUnsubscribe(chatID int64, managerID int64) {
 	db.First(&subscription, "chat_id = ?", chatID)
 	if subscription.UUID != "" {
 		subscription.ReceiveMsgs = false
-		db.Save(&subscription)
+		saveSubscription(&subscription)
 		bot.Send(tgbotapi.NewMessage(managerID, "Unsubscribed"))
 	} else {
 		bot.Send(tgbotapi.NewMessage(managerID, "Invalid UUID or not subscribed"))
@@ -214,13 +327,28 @@ func handleInfo(chatID int64, managerID int64) {
 	if subscription.UUID != "" {
 		subscription.NickName = chat.FirstName + " " + chat.LastName
 		subscription.UserName = chat.UserName
-		db.Save(&subscription)
+		saveSubscription(&subscription)
 		msgText := ""
 		msgText += "Your chat ID: `" + strconv.FormatInt(chatID, 10) + "`\n\n"
 		msgText += "Your username: `" + subscription.UserName + "`\n\n"
 		msgText += "Your nickname: `" + subscription.NickName + "`\n\n"
 		msgText += "Your UUID: `" + subscription.UUID + "`\n\n"
 		msgText += "Your AES key: `" + subscription.AESKey + "`\n\n"
+		if subscription.SigningSecret != "" {
+			msgText += "Your signing secret: `" + subscription.SigningSecret + "`\n\n"
+		}
+		if subscription.RequireSignature {
+			msgText += "Requests must be signed\n"
+		}
+		if subscription.ThreadID != 0 {
+			msgText += "Notifications go to topic " + strconv.Itoa(subscription.ThreadID) + "\n"
+		}
+		if subscription.QuietHours != "" {
+			msgText += describeQuietHours(&subscription) + "\n"
+		}
+		if inGracePeriod(&subscription) {
+			msgText += "Your previous UUID `" + subscription.PreviousUUID + "` and AES key keep working until " + subscription.PreviousExpiresAt.UTC().Format(time.RFC3339) + "\n"
+		}
 		if subscription.ReceiveMsgs {
 			msgText += "You are subscribed to receive messages\n"
 		} else {
@@ -235,6 +363,147 @@ func handleInfo(chatID int64, managerID int64) {
 	}
 }
 
+// handleSigning shows or changes how requests for chatID are authenticated:
+// "on" and "off" make signatures mandatory or optional, "secret" generates a
+// dedicated signing secret and "reset" goes back to signing with the AES key.
+func handleSigning(chatID int64, managerID int64, args []string) {
+	var subscription Subscription
+	db.First(&subscription, "chat_id = ?", chatID)
+	if subscription.UUID == "" {
+		bot.Send(tgbotapi.NewMessage(managerID, "Invalid UUID or not subscribed"))
+		return
+	}
+	action := ""
+	if len(args) > 0 {
+		action = strings.ToLower(args[0])
+	}
+	switch action {
+	case "":
+	case "on":
+		subscription.RequireSignature = true
+	case "off":
+		subscription.RequireSignature = false
+	case "secret":
+		secret, err := generateRandomAESKey()
+		if err != nil {
+			logger.Error("Failed to generate signing secret", zap.Error(err))
+			bot.Send(tgbotapi.NewMessage(managerID, "Failed to generate signing secret"))
+			return
+		}
+		subscription.SigningSecret = secret
+	case "reset":
+		subscription.SigningSecret = ""
+	default:
+		bot.Send(tgbotapi.NewMessage(managerID, "Usage: /signing [on|off|secret|reset]"))
+		return
+	}
+	if action != "" {
+		saveSubscription(&subscription)
+	}
+	msgText := ""
+	if subscription.RequireSignature {
+		msgText += "Requests must be signed\n\n"
+	} else {
+		msgText += "Requests may be signed\n\n"
+	}
+	if subscription.SigningSecret != "" {
+		msgText += "Your signing secret: `" + subscription.SigningSecret + "`\n\n"
+	} else {
+		msgText += "Requests are signed with your AES key\n\n"
+	}
+	msgText += "Send the headers `X-Timestamp` (Unix time in seconds) and `X-Signature` (hex HMAC-SHA256 of the timestamp followed by the request body, or by the query string for GET requests)"
+	sendMarkdownV2(managerID, msgText)
+}
+
+// handleTokenNew creates an API token for chatID. The last argument is
+// taken as expiry if it parses as one, everything before it is the label.
+// A token created in a forum topic of the chat sends to that topic by
+// default.
+func handleTokenNew(chatID int64, managerID int64, threadID int, args []string) {
+	var subscription Subscription
+	db.First(&subscription, "chat_id = ?", chatID)
+	if subscription.UUID == "" {
+		bot.Send(tgbotapi.NewMessage(managerID, "Invalid UUID or not subscribed"))
+		return
+	}
+	var validFor time.Duration
+	if len(args) > 1 {
+		if d, err := parseTokenExpiry(args[len(args)-1]); err == nil {
+			validFor = d
+			args = args[:len(args)-1]
+		}
+	}
+	label := strings.Join(args, " ")
+	if label == "" {
+		bot.Send(tgbotapi.NewMessage(managerID, "Usage: /token_new <label> [expiry, e.g. 30d or 12h]"))
+		return
+	}
+	if chatID != managerID {
+		threadID = 0
+	}
+	token, err := newToken(chatID, label, validFor, threadID)
+	if err != nil {
+		logger.Error("Failed to create token", zap.Error(err))
+		bot.Send(tgbotapi.NewMessage(managerID, "Failed to create token"))
+		return
+	}
+	msgText := "Created token " + strconv.FormatUint(uint64(token.ID), 10) + " (" + label + ")\n\n"
+	msgText += "Your token: `" + token.Secret + "`\n\n"
+	if token.ExpiresAt != nil {
+		msgText += "Expires: " + token.ExpiresAt.Format(time.RFC3339) + "\n\n"
+	}
+	if token.ThreadID != 0 {
+		msgText += "Its notifications go to the topic it was created in\n\n"
+	}
+	msgText += "Use it in place of your UUID, e.g. `" + config.PostURL + "/api/" + token.Secret + "/json`"
+	sendMarkdownV2(managerID, msgText)
+}
+
+func handleTokens(chatID int64, managerID int64) {
+	var tokens []Token
+	db.Where("chat_id = ? AND revoked_at IS NULL", chatID).Order("id").Find(&tokens)
+	if len(tokens) == 0 {
+		bot.Send(tgbotapi.NewMessage(managerID, "No API tokens, use /token_new <label> to create one"))
+		return
+	}
+	msgText := "Your API tokens:\n\n"
+	for _, token := range tokens {
+		msgText += strconv.FormatUint(uint64(token.ID), 10) + ". " + token.Label + " (`" + token.Secret[:6] + "…`)\n"
+		msgText += "  created " + token.CreatedAt.Format(time.RFC3339)
+		if token.LastUsedAt != nil {
+			msgText += ", last used " + token.LastUsedAt.Format(time.RFC3339)
+		} else {
+			msgText += ", never used"
+		}
+		if token.ExpiresAt != nil {
+			if token.ExpiresAt.Before(time.Now()) {
+				msgText += ", expired " + token.ExpiresAt.Format(time.RFC3339)
+			} else {
+				msgText += ", expires " + token.ExpiresAt.Format(time.RFC3339)
+			}
+		}
+		msgText += "\n"
+	}
+	sendMarkdownV2(managerID, msgText)
+}
+
+func handleTokenRevoke(chatID int64, managerID int64, args []string) {
+	if len(args) != 1 {
+		bot.Send(tgbotapi.NewMessage(managerID, "Usage: /token_revoke <id>"))
+		return
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(managerID, "Invalid token ID: "+args[0]))
+		return
+	}
+	if err := revokeToken(chatID, uint(id)); err != nil {
+		bot.Send(tgbotapi.NewMessage(managerID, "Failed to revoke token: "+err.Error()))
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(managerID, "Revoked token "+args[0]))
+}
+
 func handleHelp(chatID int64, managerID int64) {
 	subscription := Subscription{}
 	db.First(&subscription, "chat_id = ?", chatID)
@@ -244,21 +513,34 @@ func handleHelp(chatID int64, managerID int64) {
 	} else {
 		uuidStr = "<UUID>"
 	}
-	helpText := "Please see [ReadMe](\"" + config.PostURL + "\") for more information\n\n"
+	helpText := "Please see [ReadMe](" + config.PostURL + ") for more information\n\n"
 	helpText = helpText + `
 Here are the available commands:
 
-- /subscribe: Subscribe to receive messages
+- /subscribe: Subscribe to receive messages; in a forum topic, messages go to that topic
 - /unsubscribe: Unsubscribe from receiving messages
-- /regenerate: Regenerate UUID and AES key
+- /regenerate [now]: Regenerate UUID and AES key. The old ones keep working for a grace period unless "now" is given
 - /info: Get your chat ID, UUID and AES key
+- /token_new <label> [expiry]: Create an additional API token, e.g. one per host, that can be used in place of the UUID; in a forum topic, its messages go to that topic
+- /tokens: List your API tokens
+- /token_revoke <id>: Revoke an API token
+- /reply_webhook [url|off]: Post replies to notifications to a webhook, or stop doing so
+- /topic_new <name> [approval]: Create a topic that notifies all of its members with one request; with approval, you approve who joins
+- /topics: List your topics and their members
+- /topic_token <name>: Replace the publish token of your topic, e.g. after it leaked
+- /topic_delete <name>: Delete your topic and remove its members
+- /join <topic>, /leave <topic>: Join or leave a topic
+- /approve <topic> <chat ID>, /reject <topic> <chat ID>: Approve a chat that asked to join your topic, or reject or remove it
+- /quiet <HH:MM-HH:MM> [time zone] [silent|digest]: Send notifications silently, or hold them for a digest, during quiet hours, e.g. /quiet 23:00-07:00 Europe/Berlin; /quiet off removes them
+- /scheduled [cancel <ID>]: List the messages scheduled for later, or cancel one
+- /signing: Require signed requests (on, off), generate a signing secret (secret) or sign with the AES key again (reset)
 
 After subscribing, you will receive a UUID and an AES key which can be used to send messages to your Telegram bot.
 
 Here are the available endpoints and how to use them:
 
 - **JSON Endpoint**:  
-  POST to ` + "`" + config.PostURL + "/api/" + uuidStr + "/json`" + ` with JSON body {"encrypted": true, "msg": "<encrypted message>"} to send an encrypted message.
+  POST to ` + "`" + config.PostURL + "/api/" + uuidStr + "/json`" + ` with JSON body {"encrypted": true, "cipher": "gcm", "msg": "<encrypted message>"} to send an encrypted message. The cipher is "gcm" or "cbc" (default).
   
 - **GET Endpoint**:  
   GET to ` + "`" + config.PostURL + "/api/" + uuidStr + "/get?msg=<message>&encrypted=<true/false>`" + ` to send a message.
@@ -267,7 +549,7 @@ Here are the available endpoints and how to use them:
   POST to ` + "`" + config.PostURL + "/api/" + uuidStr + "/form`" + ` with form data msg=<message>, encrypted=<true/false> to send a message.
   
 - **File Endpoint**:  
-  POST to ` + "`" + config.PostURL + "/api/" + uuidStr + "/file`" + ` with form data file=<file> to send a file.
+  POST to ` + "`" + config.PostURL + "/api/" + uuidStr + "/file`" + ` with form data file=<file> and an optional caption to send a file. Images, videos and audio are shown inline; set type=<document/photo/video/audio/voice/animation> to choose yourself. Add encrypted=true and cipher=<gcm/cbc> to send an encrypted file.
 
 More information can be found at [nerdneilsfield/simple-telegram-notification-bot](https://github.com/nerdneilsfield/simple-telegram-notification-bot)
 `
@@ -311,23 +593,25 @@ func checkIsForwardedChannelMessage(update tgbotapi.Update) bool {
 	return false
 }
 
-func getChatIDFromCommandArguments(args string) int64 {
-	if args == "" {
-		return 0
+// parseCommandArguments splits the arguments of a command. A leading
+// negative integer is the ID of the channel or group the command is meant
+// for; other chats can only be managed from themselves.
+func parseCommandArguments(args string) (int64, []string) {
+	arguments := strings.Fields(args)
+	if len(arguments) == 0 {
+		return 0, nil
 	}
-	arguments := strings.TrimSpace(args)
-	chatID, err := strconv.ParseInt(arguments, 10, 64)
-	if err != nil {
-		logger.Error("Failed to parse chat ID", zap.Error(err))
-		return 0
+	chatID, err := strconv.ParseInt(arguments[0], 10, 64)
+	if err != nil || chatID >= 0 {
+		return 0, arguments
 	}
-	return chatID
+	return chatID, arguments[1:]
 }
 
-func processCommand(update tgbotapi.Update) {
+func processCommand(update tgbotapi.Update, threadID int) {
 	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
 
-	chatID := getChatIDFromCommandArguments(update.Message.CommandArguments())
+	chatID, args := parseCommandArguments(update.Message.CommandArguments())
 	if chatID == 0 {
 		chatID = update.Message.Chat.ID
 	}
@@ -344,11 +628,11 @@ func processCommand(update tgbotapi.Update) {
 	case "start":
 		handleHelp(chatID, update.Message.Chat.ID)
 	case "subscribe":
-		handleSubscribe(chatID, update.Message.Chat.ID)
+		handleSubscribe(chatID, update.Message.Chat.ID, threadID)
 	case "unsubscribe":
 		handleUnsubscribe(chatID, update.Message.Chat.ID)
 	case "regenerate":
-		handleRegenerate(chatID, update.Message.Chat.ID)
+		handleRegenerate(chatID, update.Message.Chat.ID, args)
 	case "version":
 		versionData, err := loadEmbeddedFile("VERSION")
 		if err != nil {
@@ -358,6 +642,36 @@ func processCommand(update tgbotapi.Update) {
 		}
 	case "info":
 		handleInfo(chatID, update.Message.Chat.ID)
+	case "signing":
+		handleSigning(chatID, update.Message.Chat.ID, args)
+	case "token_new":
+		handleTokenNew(chatID, update.Message.Chat.ID, threadID, args)
+	case "tokens":
+		handleTokens(chatID, update.Message.Chat.ID)
+	case "token_revoke":
+		handleTokenRevoke(chatID, update.Message.Chat.ID, args)
+	case "reply_webhook":
+		handleReplyWebhook(chatID, update.Message.Chat.ID, args)
+	case "quiet":
+		handleQuiet(chatID, update.Message.Chat.ID, args)
+	case "scheduled":
+		handleScheduled(chatID, update.Message.Chat.ID, args)
+	case "topic_new":
+		handleTopicNew(chatID, update.Message.Chat.ID, args)
+	case "topics":
+		handleTopics(chatID, update.Message.Chat.ID)
+	case "topic_token":
+		handleTopicToken(chatID, update.Message.Chat.ID, args)
+	case "topic_delete":
+		handleTopicDelete(chatID, update.Message.Chat.ID, args)
+	case "join":
+		handleJoin(chatID, update.Message.Chat.ID, args)
+	case "leave":
+		handleLeave(chatID, update.Message.Chat.ID, args)
+	case "approve":
+		handleTopicMember(chatID, update.Message.Chat.ID, args, true)
+	case "reject":
+		handleTopicMember(chatID, update.Message.Chat.ID, args, false)
 	case "help":
 		handleHelp(chatID, update.Message.Chat.ID)
 	default:
@@ -439,6 +753,16 @@ func processForwardedChannelMessage(update tgbotapi.Update) {
 func processCallbackQuery(update tgbotapi.Update) {
 	logger.Info("Receive callback query", zap.String("data", update.CallbackQuery.Data))
 
+	if data, ok := strings.CutPrefix(update.CallbackQuery.Data, notificationCallbackPrefix); ok {
+		processNotificationCallback(update.CallbackQuery, data)
+		return
+	}
+	if id, ok := strings.CutPrefix(update.CallbackQuery.Data, storedCallbackPrefix); ok {
+		// Posting to the webhook must not hold up other updates.
+		go processStoredCallback(update.CallbackQuery, id)
+		return
+	}
+
 	keyboardCallbackData := deserializeKeyboardCallbackData(update.CallbackQuery.Data)
 	if keyboardCallbackData.Command == "" {
 		logger.Error("Failed to deserialize keyboard callback data")
@@ -446,11 +770,11 @@ func processCallbackQuery(update tgbotapi.Update) {
 	} else {
 		switch keyboardCallbackData.Command {
 		case "subscribe":
-			handleSubscribe(keyboardCallbackData.CommandChatID, keyboardCallbackData.CurrentChatID)
+			handleSubscribe(keyboardCallbackData.CommandChatID, keyboardCallbackData.CurrentChatID, 0)
 		case "unsubscribe":
 			handleUnsubscribe(keyboardCallbackData.CommandChatID, keyboardCallbackData.CurrentChatID)
 		case "regenerate":
-			handleRegenerate(keyboardCallbackData.CommandChatID, keyboardCallbackData.CurrentChatID)
+			handleRegenerate(keyboardCallbackData.CommandChatID, keyboardCallbackData.CurrentChatID, nil)
 		case "info":
 			handleInfo(keyboardCallbackData.CommandChatID, keyboardCallbackData.CurrentChatID)
 		default:
@@ -471,7 +795,9 @@ func processCallbackQuery(update tgbotapi.Update) {
 	delete(inMemoyrChatStore, keyboardCallbackData.CurrentMessageID)
 }
 
-func processUpdate(update tgbotapi.Update) {
+// processUpdate handles an update from Telegram; threadID is the forum topic
+// its message was sent in.
+func processUpdate(update tgbotapi.Update, threadID int) {
 	if update.Message != nil {
 
 		logger.Info("[%s] %s", zap.Int("update_id", update.UpdateID), zap.String("message", update.Message.Text))
@@ -481,7 +807,13 @@ func processUpdate(update tgbotapi.Update) {
 		}
 
 		if update.Message.IsCommand() {
-			processCommand(update)
+			processCommand(update, threadID)
+			return
+		}
+
+		if isReplyToBot(update.Message) {
+			// Posting to the webhook must not hold up other updates.
+			go processReply(update.Message)
 			return
 		}
 	} else if update.CallbackQuery != nil {
@@ -493,11 +825,5 @@ func processUpdate(update tgbotapi.Update) {
 }
 
 func startBot() {
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-
-	updates := bot.GetUpdatesChan(u)
-	for update := range updates {
-		processUpdate(update)
-	}
+	receiveUpdates()
 }
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestParseCommandArguments(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantChat int64
+		wantArgs []string
+	}{
+		{"", 0, nil},
+		{"-1001234", -1001234, []string{}},
+		{" -1001234  on ", -1001234, []string{"on"}},
+		{"on", 0, []string{"on"}},
+		{"5", 0, []string{"5"}},
+	}
+	for _, tt := range tests {
+		chatID, args := parseCommandArguments(tt.in)
+		if chatID != tt.wantChat || len(args) != len(tt.wantArgs) || (len(args) > 0 && args[0] != tt.wantArgs[0]) {
+			t.Errorf("parseCommandArguments(%q) = %d, %q, want %d, %q", tt.in, chatID, args, tt.wantChat, tt.wantArgs)
+		}
+	}
+}
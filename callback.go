@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"html"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+// CallbackEvent is posted to the webhook of a notification when one of its
+// callback buttons is pressed.
+type CallbackEvent struct {
+	DeliveryID   string      `json:"delivery_id"`
+	ChatID       int64       `json:"chat_id"`
+	MessageID    int         `json:"message_id"`
+	CallbackData string      `json:"callback_data"`
+	ButtonText   string      `json:"button_text"`
+	User         WebhookUser `json:"user"`
+	PressedAt    time.Time   `json:"pressed_at"`
+}
+
+func newCallbackID() (string, error) {
+	id := make([]byte, 9)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
+
+// prepareCallbacks stores the callback buttons of a message sent with a
+// webhook under new short IDs, which Telegram gets in place of their
+// callback data. Without a webhook the callback data is sent as is.
+func prepareCallbacks(buttons [][]Button, chatID int64, webhook string) ([]NotificationCallback, error) {
+	var callbacks []NotificationCallback
+	for i := range buttons {
+		for j := range buttons[i] {
+			button := &buttons[i][j]
+			button.CallbackID = ""
+			if webhook == "" || button.CallbackData == "" {
+				continue
+			}
+			id, err := newCallbackID()
+			if err != nil {
+				return nil, err
+			}
+			button.CallbackID = id
+			callbacks = append(callbacks, NotificationCallback{ShortID: id, ChatID: chatID, Text: button.Text, Data: button.CallbackData, Webhook: webhook})
+		}
+	}
+	return callbacks, nil
+}
+
+// processStoredCallback posts the press of a stored callback button to the
+// webhook of its notification and edits the message to show the choice.
+// The first press answers the notification; later ones are turned down.
+func processStoredCallback(query *tgbotapi.CallbackQuery, id string) {
+	answer := func(text string) {
+		if _, err := bot.Request(tgbotapi.NewCallback(query.ID, text)); err != nil {
+			logger.Error("Failed to answer callback query", zap.Error(err))
+		}
+	}
+	var callback NotificationCallback
+	if err := db.Where("short_id = ?", id).First(&callback).Error; err != nil || query.Message == nil || query.Message.Chat.ID != callback.ChatID {
+		answer("This button is no longer available")
+		return
+	}
+	claim := db.Model(&NotificationCallback{}).Where("delivery_id = ? AND answered_at IS NULL", callback.DeliveryID).Update("answered_at", time.Now())
+	if claim.Error != nil || claim.RowsAffected == 0 {
+		answer("This was already answered")
+		return
+	}
+	var delivery Delivery
+	db.First(&delivery, callback.DeliveryID)
+	var subscription Subscription
+	db.First(&subscription, "chat_id = ?", callback.ChatID)
+	user := newWebhookUser(query.From)
+	event := CallbackEvent{
+		DeliveryID:   delivery.UUID,
+		ChatID:       callback.ChatID,
+		MessageID:    query.Message.MessageID,
+		CallbackData: callback.Data,
+		ButtonText:   callback.Text,
+		User:         user,
+		PressedAt:    time.Now(),
+	}
+	if err := postWebhook(callback.Webhook, &subscription, event); err != nil {
+		logger.Error("Failed to post callback to webhook", zap.String("delivery", delivery.UUID), zap.Error(err))
+		db.Model(&NotificationCallback{}).Where("delivery_id = ?", callback.DeliveryID).Update("answered_at", nil)
+		answer("Failed to send your choice, please try again")
+		return
+	}
+	answer("Sent: " + callback.Text)
+	showChoice(&delivery, query.Message, user.displayName()+" chose "+callback.Text)
+}
+
+// showChoice appends line to the message that carried the keyboard of
+// delivery, the last one it was split into, and drops its callback buttons.
+func showChoice(delivery *Delivery, message *tgbotapi.Message, line string) {
+	parts, parseMode, err := renderMessage(delivery.Text, delivery.Format, delivery.Overflow, delivery.UUID)
+	if err != nil {
+		logger.Error("Failed to render message for edit", zap.String("delivery", delivery.UUID), zap.Error(err))
+		return
+	}
+	edit := tgbotapi.NewEditMessageText(message.Chat.ID, message.MessageID, parts[len(parts)-1]+"\n\n"+escapeForParseMode(line, parseMode))
+	edit.ParseMode = parseMode
+	edit.DisableWebPagePreview = delivery.DisablePreview
+	edit.ReplyMarkup = inlineKeyboard(urlButtons(delivery.Buttons))
+	if _, err := send(message.Chat.ID, edit); err != nil {
+		logger.Error("Failed to show choice", zap.String("delivery", delivery.UUID), zap.Error(err))
+	}
+}
+
+// urlButtons keeps the URL buttons of a keyboard.
+func urlButtons(rows [][]Button) [][]Button {
+	var kept [][]Button
+	for _, row := range rows {
+		var keptRow []Button
+		for _, button := range row {
+			if button.URL != "" {
+				keptRow = append(keptRow, button)
+			}
+		}
+		if len(keptRow) > 0 {
+			kept = append(kept, keptRow)
+		}
+	}
+	return kept
+}
+
+// escapeForParseMode makes plain text safe to add to a message in parseMode.
+func escapeForParseMode(text string, parseMode string) string {
+	switch parseMode {
+	case tgbotapi.ModeMarkdownV2:
+		return escapeMarkdownV2(text)
+	case tgbotapi.ModeHTML:
+		return html.EscapeString(text)
+	}
+	return text
+}
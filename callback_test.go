@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrepareCallbacks(t *testing.T) {
+	openTestDB(t)
+	buttons := [][]Button{
+		{{Text: "Approve", CallbackData: "approve"}, {Text: "Reject", CallbackData: "reject"}},
+		{{Text: "Pipeline", URL: "https://ci.example.org/1", CallbackID: "forged"}},
+	}
+	callbacks, err := prepareCallbacks(buttons, 1, "https://ci.example.org/hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(callbacks) != 2 || buttons[0][0].CallbackID == "" || buttons[0][0].CallbackID == buttons[0][1].CallbackID || buttons[1][0].CallbackID != "" {
+		t.Fatalf("prepareCallbacks() = %+v, buttons %+v", callbacks, buttons)
+	}
+	keyboard := inlineKeyboard(buttons)
+	if data := *keyboard.InlineKeyboard[0][0].CallbackData; data != storedCallbackPrefix+buttons[0][0].CallbackID {
+		t.Errorf("callback data sent to Telegram = %q", data)
+	}
+
+	delivery := Delivery{ChatID: 1, Kind: deliveryKindText, Text: "Deploy?", Buttons: buttons, Callbacks: callbacks}
+	if err := enqueueDelivery(&delivery); err != nil {
+		t.Fatal(err)
+	}
+	var stored NotificationCallback
+	if err := db.Where("short_id = ?", buttons[0][1].CallbackID).First(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.DeliveryID != delivery.ID || stored.Data != "reject" || stored.Webhook != "https://ci.example.org/hook" {
+		t.Errorf("stored callback = %+v", stored)
+	}
+
+	if callbacks, _ := prepareCallbacks(buttons, 1, ""); len(callbacks) != 0 || buttons[0][0].CallbackID != "" {
+		t.Errorf("callbacks stored without a webhook: %+v", callbacks)
+	}
+}
+
+func TestPostWebhookIsSigned(t *testing.T) {
+	config.WebhookTimeout = time.Second
+	subscription := &Subscription{AESKey: testAESKey}
+	var got CallbackEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(signatureHeader) != signForTest(testAESKey, r.Header.Get(timestampHeader), body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		json.Unmarshal(body, &got)
+	}))
+	defer server.Close()
+
+	event := CallbackEvent{DeliveryID: "d1", CallbackData: "approve", User: WebhookUser{ID: 7, UserName: "alice"}}
+	if err := postWebhook(server.URL, subscription, event); err != nil {
+		t.Fatalf("postWebhook() = %v", err)
+	}
+	if got.CallbackData != "approve" || got.User.ID != 7 {
+		t.Errorf("webhook got %+v", got)
+	}
+	subscription.SigningSecret = "other"
+	if err := postWebhook(server.URL, subscription, event); err == nil {
+		t.Error("postWebhook() ignored an error status")
+	}
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+	config.WebhookAllowedHosts = nil
+	t.Cleanup(func() { config.WebhookAllowedHosts = nil })
+	if err := checkWebhookURL("https://ci.example.org/hook"); err == nil {
+		t.Error("accepted a webhook while webhooks are disabled")
+	}
+	config.WebhookAllowedHosts = []string{"*"}
+	if err := checkWebhookURL("https://ci.example.org/hook"); err != nil {
+		t.Errorf("checkWebhookURL() = %v", err)
+	}
+	if err := checkWebhookURL("ftp://ci.example.org/hook"); err == nil {
+		t.Error("accepted an ftp webhook")
+	}
+	config.WebhookAllowedHosts = []string{"*.example.org"}
+	if err := checkWebhookURL("https://ci.example.org/hook"); err != nil {
+		t.Errorf("checkWebhookURL() = %v", err)
+	}
+	if err := checkWebhookURL("https://169.254.169.254/latest"); err == nil {
+		t.Error("accepted a webhook on a host that is not allowed")
+	}
+}
+
+func TestURLButtons(t *testing.T) {
+	rows := [][]Button{
+		{{Text: "Approve", CallbackData: "approve"}, {Text: "Reject", CallbackData: "reject"}},
+		{{Text: "Pipeline", URL: "https://ci.example.org/1"}, {Text: "Later", CallbackData: "later"}},
+	}
+	kept := urlButtons(rows)
+	if len(kept) != 1 || len(kept[0]) != 1 || kept[0][0].Text != "Pipeline" {
+		t.Errorf("urlButtons() = %+v", kept)
+	}
+}
@@ -0,0 +1,210 @@
+// Command encrypt prints a message encrypted for the notification bot.
+//
+//	go run ./clients/go -key <AES key> -cipher gcm "message"
+//	go run ./clients/go -key <AES key> -cipher gcm -file report.pdf > report.pdf.enc
+//
+// The output is used as the msg field (or, with -file, as the uploaded file)
+// together with encrypted=true and the same cipher.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// encryptCBC returns base64(IV || AES-CBC ciphertext) with PKCS#7 padding.
+func encryptCBC(plaintext []byte, key []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte(nil), plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	out := make([]byte, aes.BlockSize+len(padded))
+	iv := out[:aes.BlockSize]
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out[aes.BlockSize:], padded)
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+// encryptGCM returns base64(nonce || AES-GCM ciphertext || tag).
+func encryptGCM(plaintext []byte, key []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// fileChunkSize is the plaintext size of one record of an encrypted file.
+const fileChunkSize = 64 * 1024
+
+// encryptFileGCM writes the nonce followed by records of fileChunkSize
+// plaintext bytes, each sealed on its own. Record i uses the nonce with the
+// big-endian counter i XORed into its last four bytes and the additional
+// data {1} for the last record, {0} otherwise. The last record is always
+// shorter than fileChunkSize, so it is empty for files that are a multiple
+// of the record size.
+func encryptFileGCM(dst io.Writer, src io.Reader, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if _, err := dst.Write(nonce); err != nil {
+		return err
+	}
+	chunk := make([]byte, fileChunkSize)
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(src, chunk)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return err
+		}
+		recordNonce := append([]byte(nil), nonce...)
+		var counter [4]byte
+		binary.BigEndian.PutUint32(counter[:], i)
+		for j := range counter {
+			recordNonce[len(recordNonce)-4+j] ^= counter[j]
+		}
+		aad := []byte{0}
+		if final {
+			aad[0] = 1
+		}
+		if _, err := dst.Write(aead.Seal(nil, recordNonce, chunk[:n], aad)); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// encryptFileCBC writes IV || AES-CBC ciphertext with PKCS#7 padding.
+func encryptFileCBC(dst io.Writer, src io.Reader, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return err
+	}
+	if _, err := dst.Write(iv); err != nil {
+		return err
+	}
+	mode := cipher.NewCBCEncrypter(block, iv)
+	buf := make([]byte, fileChunkSize)
+	for {
+		n, err := io.ReadFull(src, buf)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return err
+		}
+		data := buf[:n]
+		if final {
+			padding := aes.BlockSize - n%aes.BlockSize
+			data = append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
+		}
+		mode.CryptBlocks(data, data)
+		if _, err := dst.Write(data); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+func main() {
+	keyHex := flag.String("key", "", "AES key shown by the bot's /info command")
+	cipherName := flag.String("cipher", "gcm", "Encryption scheme: gcm or cbc")
+	filePath := flag.String("file", "", "Encrypt this file and write the result to stdout")
+	flag.Parse()
+
+	key, err := hex.DecodeString(*keyHex)
+	if err != nil || len(key) != 32 {
+		fmt.Fprintln(os.Stderr, "invalid key: expected 64 hex characters")
+		os.Exit(2)
+	}
+
+	if *filePath != "" {
+		if err := encryptFile(*filePath, key, *cipherName); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var plaintext []byte
+	if flag.NArg() > 0 {
+		plaintext = []byte(strings.Join(flag.Args(), " "))
+	} else if plaintext, err = io.ReadAll(os.Stdin); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var encrypted string
+	switch *cipherName {
+	case "gcm":
+		encrypted, err = encryptGCM(plaintext, key)
+	case "cbc":
+		encrypted, err = encryptCBC(plaintext, key)
+	default:
+		err = fmt.Errorf("unknown cipher %q", *cipherName)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(encrypted)
+}
+
+func encryptFile(path string, key []byte, cipherName string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst := bufio.NewWriter(os.Stdout)
+	switch cipherName {
+	case "gcm":
+		err = encryptFileGCM(dst, src, key)
+	case "cbc":
+		err = encryptFileCBC(dst, src, key)
+	default:
+		err = fmt.Errorf("unknown cipher %q", cipherName)
+	}
+	if err != nil {
+		return err
+	}
+	return dst.Flush()
+}
@@ -0,0 +1,101 @@
+#!/usr/bin/env python3
+"""Encrypt a message for the notification bot.
+
+    pip install cryptography
+    python3 encrypt.py --key <AES key> --cipher gcm "message"
+    python3 encrypt.py --key <AES key> --cipher gcm --file report.pdf > report.pdf.enc
+
+The output is used as the msg field (or, with --file, as the uploaded file)
+together with encrypted=true and the same cipher.
+"""
+
+import argparse
+import base64
+import os
+import struct
+import sys
+
+from cryptography.hazmat.primitives import padding
+from cryptography.hazmat.primitives.ciphers import Cipher, algorithms, modes
+from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+
+
+def encrypt_cbc(plaintext: bytes, key: bytes) -> str:
+    """Return base64(IV || AES-CBC ciphertext) with PKCS#7 padding."""
+    iv = os.urandom(16)
+    padder = padding.PKCS7(128).padder()
+    padded = padder.update(plaintext) + padder.finalize()
+    encryptor = Cipher(algorithms.AES(key), modes.CBC(iv)).encryptor()
+    return base64.b64encode(iv + encryptor.update(padded) + encryptor.finalize()).decode()
+
+
+def encrypt_gcm(plaintext: bytes, key: bytes) -> str:
+    """Return base64(nonce || AES-GCM ciphertext || tag)."""
+    nonce = os.urandom(12)
+    return base64.b64encode(nonce + AESGCM(key).encrypt(nonce, plaintext, None)).decode()
+
+
+FILE_CHUNK_SIZE = 64 * 1024
+
+
+def encrypt_file_cbc(src, dst, key: bytes) -> None:
+    """Write IV || AES-CBC ciphertext with PKCS#7 padding."""
+    iv = os.urandom(16)
+    dst.write(iv)
+    padder = padding.PKCS7(128).padder()
+    encryptor = Cipher(algorithms.AES(key), modes.CBC(iv)).encryptor()
+    while chunk := src.read(FILE_CHUNK_SIZE):
+        dst.write(encryptor.update(padder.update(chunk)))
+    dst.write(encryptor.update(padder.finalize()) + encryptor.finalize())
+
+
+def encrypt_file_gcm(src, dst, key: bytes) -> None:
+    """Write the nonce followed by records of FILE_CHUNK_SIZE plaintext bytes.
+
+    Record i is sealed with the nonce whose last four bytes are XORed with the
+    big-endian counter i, and with the additional data b"\\x01" for the last
+    record, b"\\x00" otherwise. The last record is always shorter than
+    FILE_CHUNK_SIZE, so it is empty for files that are a multiple of it.
+    """
+    aead = AESGCM(key)
+    nonce = os.urandom(12)
+    dst.write(nonce)
+    counter = 0
+    while True:
+        chunk = src.read(FILE_CHUNK_SIZE)
+        while len(chunk) < FILE_CHUNK_SIZE and (more := src.read(FILE_CHUNK_SIZE - len(chunk))):
+            chunk += more
+        final = len(chunk) < FILE_CHUNK_SIZE
+        tail = struct.unpack(">I", nonce[8:])[0] ^ counter
+        record_nonce = nonce[:8] + struct.pack(">I", tail)
+        dst.write(aead.encrypt(record_nonce, chunk, b"\x01" if final else b"\x00"))
+        if final:
+            return
+        counter += 1
+
+
+def main() -> None:
+    parser = argparse.ArgumentParser(description=__doc__.splitlines()[0])
+    parser.add_argument("--key", required=True, help="AES key shown by the bot's /info command")
+    parser.add_argument("--cipher", choices=["gcm", "cbc"], default="gcm")
+    parser.add_argument("--file", help="encrypt this file and write the result to stdout")
+    parser.add_argument("message", nargs="*", help="message to encrypt, read from stdin if omitted")
+    args = parser.parse_args()
+
+    key = bytes.fromhex(args.key)
+    if len(key) != 32:
+        sys.exit("invalid key: expected 64 hex characters")
+    if args.file:
+        encrypt_file = encrypt_file_gcm if args.cipher == "gcm" else encrypt_file_cbc
+        with open(args.file, "rb") as src:
+            encrypt_file(src, sys.stdout.buffer, key)
+        return
+
+    plaintext = " ".join(args.message).encode() if args.message else sys.stdin.buffer.read()
+
+    encrypt = encrypt_gcm if args.cipher == "gcm" else encrypt_cbc
+    print(encrypt(plaintext, key))
+
+
+if __name__ == "__main__":
+    main()
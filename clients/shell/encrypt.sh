@@ -0,0 +1,41 @@
+#!/bin/sh
+# Encrypt a message or file for the notification bot with AES-256-CBC.
+#
+#   ./encrypt.sh <AES key> "message"
+#   echo "message" | ./encrypt.sh <AES key>
+#   ./encrypt.sh -f report.pdf <AES key> > report.pdf.enc
+#
+# The output is used as the msg field (or, with -f, as the uploaded file)
+# together with encrypted=true and cipher=cbc. `openssl enc` cannot produce
+# AES-GCM; use the Go or Python helper for the authenticated scheme.
+# Requires openssl and xxd.
+set -eu
+
+file=
+if [ "${1:-}" = "-f" ] && [ $# -ge 3 ]; then
+	file=$2
+	shift 2
+fi
+if [ $# -lt 1 ]; then
+	echo "usage: $0 [-f file] <AES key> [message]" >&2
+	exit 2
+fi
+
+key=$1
+shift
+iv=$(openssl rand -hex 16)
+
+encrypt() {
+	printf '%s' "$iv" | xxd -r -p
+	openssl enc -aes-256-cbc -K "$key" -iv "$iv"
+}
+
+if [ -n "$file" ]; then
+	encrypt < "$file"
+elif [ $# -gt 0 ]; then
+	printf '%s' "$*" | encrypt | openssl base64 -A
+	echo
+else
+	encrypt | openssl base64 -A
+	echo
+fi
@@ -1 +1,42 @@
 package main
+
+import "time"
+
+// applyConfigDefaults fills in the optional settings that were left out of
+// the config file.
+func applyConfigDefaults(config *Config) {
+	if config.QueueWorkers <= 0 {
+		config.QueueWorkers = 4
+	}
+	if config.QueueMaxAttempts <= 0 {
+		config.QueueMaxAttempts = 8
+	}
+	if config.QueueRetryBase <= 0 {
+		config.QueueRetryBase = 2 * time.Second
+	}
+	if config.QueueRetryMax <= 0 {
+		config.QueueRetryMax = 5 * time.Minute
+	}
+	if config.SignatureWindow <= 0 {
+		config.SignatureWindow = 5 * time.Minute
+	}
+	if config.RegenerateGrace <= 0 {
+		config.RegenerateGrace = 24 * time.Hour
+	}
+	if config.RegenerateReminder <= 0 {
+		config.RegenerateReminder = time.Hour
+	}
+	if config.FetchMaxSize <= 0 {
+		// The most a bot may upload to Telegram.
+		config.FetchMaxSize = 50 << 20
+	}
+	if config.FetchTimeout <= 0 {
+		config.FetchTimeout = 30 * time.Second
+	}
+	if config.WebhookTimeout <= 0 {
+		config.WebhookTimeout = 10 * time.Second
+	}
+	if config.IdempotencyWindow <= 0 {
+		config.IdempotencyWindow = 24 * time.Hour
+	}
+}
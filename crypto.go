@@ -5,12 +5,24 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"math"
 
 	"go.uber.org/zap"
 )
 
+const (
+	cipherCBC = "cbc"
+	cipherGCM = "gcm"
+)
+
+func isValidCipher(name string) bool {
+	return name == "" || name == cipherCBC || name == cipherGCM
+}
+
 func generateRandomAESKey() (string, error) {
 	// 为 AES-256，密钥长度为 32 字节
 	key := make([]byte, 32)
@@ -21,10 +33,50 @@ func generateRandomAESKey() (string, error) {
 	return hex.EncodeToString(key), nil
 }
 
-func decrypt(encrypted string, key string) (string, error) {
+// decryptMessage decrypts a base64 encoded message with the given scheme:
+// "cbc" (the default) or the authenticated "gcm".
+func decryptMessage(encrypted string, key string, cipherName string) (string, error) {
+	if cipherName == cipherGCM {
+		return decryptGCM(encrypted, key)
+	}
+	return decrypt(encrypted, key)
+}
+
+func newAESCipher(key string) (cipher.Block, error) {
 	keyBytes, err := hex.DecodeString(key)
 	if err != nil {
 		logger.Error("Failed to decode key", zap.Error(err))
+		return nil, err
+	}
+	block, err := aes.NewCipher(keyBytes)
+	if err != nil {
+		logger.Error("Failed to create cipher", zap.Error(err))
+		return nil, err
+	}
+	return block, nil
+}
+
+// pkcs7Unpad strips and validates PKCS#7 padding.
+func pkcs7Unpad(data []byte, blockSize int) ([]byte, error) {
+	if len(data) == 0 || len(data)%blockSize != 0 {
+		return nil, fmt.Errorf("invalid padded data length")
+	}
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > blockSize {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	for _, b := range data[len(data)-padding:] {
+		if int(b) != padding {
+			return nil, fmt.Errorf("invalid padding")
+		}
+	}
+	return data[:len(data)-padding], nil
+}
+
+// decrypt decrypts base64(IV || AES-CBC ciphertext) with PKCS#7 padding.
+func decrypt(encrypted string, key string) (string, error) {
+	block, err := newAESCipher(key)
+	if err != nil {
 		return "", err
 	}
 	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
@@ -33,22 +85,180 @@ func decrypt(encrypted string, key string) (string, error) {
 		return "", err
 	}
 
-	block, err := aes.NewCipher(keyBytes)
+	if len(ciphertext) < 2*aes.BlockSize {
+		logger.Error("Ciphertext too short")
+		return "", fmt.Errorf("ciphertext too short")
+	}
+	if len(ciphertext)%aes.BlockSize != 0 {
+		logger.Error("Ciphertext is not a multiple of the block size")
+		return "", fmt.Errorf("ciphertext is not a multiple of the block size")
+	}
+
+	iv := ciphertext[:aes.BlockSize]
+	ciphertext = ciphertext[aes.BlockSize:]
+
+	mode := cipher.NewCBCDecrypter(block, iv)
+	mode.CryptBlocks(ciphertext, ciphertext)
+
+	plaintext, err := pkcs7Unpad(ciphertext, aes.BlockSize)
 	if err != nil {
-		logger.Error("Failed to create cipher", zap.Error(err))
+		logger.Error("Failed to unpad plaintext", zap.Error(err))
 		return "", err
 	}
+	return string(plaintext), nil
+}
 
-	if len(ciphertext) < aes.BlockSize {
+// decryptGCM decrypts base64(nonce || AES-GCM ciphertext || tag). Messages
+// that were tampered with fail to authenticate and are rejected.
+func decryptGCM(encrypted string, key string) (string, error) {
+	block, err := newAESCipher(key)
+	if err != nil {
+		return "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		logger.Error("Failed to create GCM", zap.Error(err))
+		return "", err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		logger.Error("Failed to decode ciphertext", zap.Error(err))
+		return "", err
+	}
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
 		logger.Error("Ciphertext too short")
 		return "", fmt.Errorf("ciphertext too short")
 	}
+	nonce := ciphertext[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		logger.Error("Failed to authenticate ciphertext", zap.Error(err))
+		return "", err
+	}
+	return string(plaintext), nil
+}
 
-	iv := ciphertext[:aes.BlockSize]
-	ciphertext = ciphertext[aes.BlockSize:]
+// fileChunkSize is the plaintext size of one record in an encrypted file.
+const fileChunkSize = 64 * 1024
 
+// decryptFile decrypts an uploaded file from src into dst without holding it
+// in memory. With "cbc" the file is IV || AES-CBC ciphertext with PKCS#7
+// padding. With "gcm" it is a 12-byte nonce followed by records of
+// fileChunkSize plaintext bytes, each sealed with AES-GCM on its own; see
+// gcmRecordNonce. The last record is shorter than fileChunkSize, possibly
+// empty, so a truncated file is detected. dst may already hold part of the
+// plaintext when an error is returned.
+func decryptFile(dst io.Writer, src io.Reader, key string, cipherName string) error {
+	if cipherName == cipherGCM {
+		return decryptFileGCM(dst, src, key)
+	}
+	return decryptFileCBC(dst, src, key)
+}
+
+func decryptFileCBC(dst io.Writer, src io.Reader, key string) error {
+	block, err := newAESCipher(key)
+	if err != nil {
+		return err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(src, iv); err != nil {
+		return fmt.Errorf("ciphertext too short")
+	}
 	mode := cipher.NewCBCDecrypter(block, iv)
-	mode.CryptBlocks(ciphertext, ciphertext)
 
-	return string(ciphertext), nil
+	// The last block carries the padding, so it is only written once the
+	// end of the file is reached.
+	buf := make([]byte, fileChunkSize)
+	var last []byte
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n%aes.BlockSize != 0 {
+			return fmt.Errorf("ciphertext is not a multiple of the block size")
+		}
+		if n > 0 {
+			if last != nil {
+				if _, err := dst.Write(last); err != nil {
+					return err
+				}
+			}
+			mode.CryptBlocks(buf[:n], buf[:n])
+			if _, err := dst.Write(buf[:n-aes.BlockSize]); err != nil {
+				return err
+			}
+			last = append(last[:0], buf[n-aes.BlockSize:n]...)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if last == nil {
+		return fmt.Errorf("ciphertext too short")
+	}
+	plaintext, err := pkcs7Unpad(last, aes.BlockSize)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(plaintext)
+	return err
+}
+
+// gcmRecordNonce derives the nonce of record i by XORing the big-endian
+// record counter into the last four bytes of the file's nonce. The last
+// record is sealed with the additional data {1}, all others with {0}, so
+// records cannot be reordered, dropped or cut off.
+func gcmRecordNonce(nonce []byte, i uint32) []byte {
+	out := append([]byte(nil), nonce...)
+	var counter [4]byte
+	binary.BigEndian.PutUint32(counter[:], i)
+	for j := range counter {
+		out[len(out)-4+j] ^= counter[j]
+	}
+	return out
+}
+
+func decryptFileGCM(dst io.Writer, src io.Reader, key string) error {
+	block, err := newAESCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(src, nonce); err != nil {
+		return fmt.Errorf("ciphertext too short")
+	}
+
+	record := make([]byte, fileChunkSize+aead.Overhead())
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(src, record)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return err
+		}
+		if n < aead.Overhead() {
+			return fmt.Errorf("ciphertext truncated")
+		}
+		aad := []byte{0}
+		if final {
+			aad[0] = 1
+		}
+		plaintext, err := aead.Open(record[:0], gcmRecordNonce(nonce, i), record[:n], aad)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(plaintext); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+		if i == math.MaxUint32 {
+			return fmt.Errorf("too many records")
+		}
+	}
 }
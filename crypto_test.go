@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+const testAESKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func encryptCBCForTest(t *testing.T, plaintext []byte, padded []byte) string {
+	t.Helper()
+	key, _ := hex.DecodeString(testAESKey)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if padded == nil {
+		padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+		padded = append(append([]byte(nil), plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	}
+	out := make([]byte, aes.BlockSize+len(padded))
+	iv := out[:aes.BlockSize]
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out[aes.BlockSize:], padded)
+	return base64.StdEncoding.EncodeToString(out)
+}
+
+func encryptGCMForTest(t *testing.T, plaintext []byte) []byte {
+	t.Helper()
+	key, _ := hex.DecodeString(testAESKey)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil)
+}
+
+func TestPKCS7Unpad(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		want    []byte
+		wantErr bool
+	}{
+		{"one byte", append([]byte("fifteen bytes!!"), 1), []byte("fifteen bytes!!"), false},
+		{"full block", bytes.Repeat([]byte{16}, 16), []byte{}, false},
+		{"several bytes", append([]byte("hello"), bytes.Repeat([]byte{11}, 11)...), []byte("hello"), false},
+		{"empty", []byte{}, nil, true},
+		{"not a block", []byte("short"), nil, true},
+		{"zero padding", append([]byte("fifteen bytes!!"), 0), nil, true},
+		{"padding too long", append([]byte("fifteen bytes!!"), 17), nil, true},
+		{"inconsistent padding", append([]byte("hello world!"), 1, 2, 3, 4), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pkcs7Unpad(tt.in, aes.BlockSize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pkcs7Unpad() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, tt.want) {
+				t.Errorf("pkcs7Unpad() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptCBC(t *testing.T) {
+	for _, plaintext := range []string{"", "hi", "exactly 16 bytes", "a longer message that spans several blocks ✓"} {
+		got, err := decryptMessage(encryptCBCForTest(t, []byte(plaintext), nil), testAESKey, cipherCBC)
+		if err != nil {
+			t.Fatalf("decrypt(%q) failed: %v", plaintext, err)
+		}
+		if got != plaintext {
+			t.Errorf("decrypt() = %q, want %q", got, plaintext)
+		}
+	}
+}
+
+func TestDecryptCBCRejectsInvalidInput(t *testing.T) {
+	tests := []struct {
+		name      string
+		encrypted string
+	}{
+		{"not base64", "%%%"},
+		{"iv only", base64.StdEncoding.EncodeToString(make([]byte, aes.BlockSize))},
+		{"partial block", base64.StdEncoding.EncodeToString(make([]byte, aes.BlockSize+10))},
+		{"bad padding", encryptCBCForTest(t, nil, []byte("sixteen bytes!!!"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decrypt(tt.encrypted, testAESKey); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestDecryptGCM(t *testing.T) {
+	plaintext := "deploy finished ✓"
+	sealed := encryptGCMForTest(t, []byte(plaintext))
+	got, err := decryptMessage(base64.StdEncoding.EncodeToString(sealed), testAESKey, cipherGCM)
+	if err != nil {
+		t.Fatalf("decryptGCM failed: %v", err)
+	}
+	if got != plaintext {
+		t.Errorf("decryptGCM() = %q, want %q", got, plaintext)
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-20] ^= 1
+	if _, err := decryptGCM(base64.StdEncoding.EncodeToString(tampered), testAESKey); err == nil {
+		t.Error("expected tampered ciphertext to be rejected")
+	}
+	if _, err := decryptGCM(base64.StdEncoding.EncodeToString(sealed[:20]), testAESKey); err == nil {
+		t.Error("expected short ciphertext to be rejected")
+	}
+	otherKey := "ff" + testAESKey[2:]
+	if _, err := decryptGCM(base64.StdEncoding.EncodeToString(sealed), otherKey); err == nil {
+		t.Error("expected wrong key to be rejected")
+	}
+}
+
+func encryptFileGCMForTest(t *testing.T, plaintext []byte) []byte {
+	t.Helper()
+	key, _ := hex.DecodeString(testAESKey)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	out := append([]byte(nil), nonce...)
+	for i := uint32(0); ; i++ {
+		chunk := plaintext
+		if len(chunk) >= fileChunkSize {
+			chunk = chunk[:fileChunkSize]
+		}
+		plaintext = plaintext[len(chunk):]
+		final := len(chunk) < fileChunkSize
+		aad := []byte{0}
+		if final {
+			aad[0] = 1
+		}
+		out = aead.Seal(out, gcmRecordNonce(nonce, i), chunk, aad)
+		if final {
+			return out
+		}
+	}
+}
+
+func TestDecryptFile(t *testing.T) {
+	sizes := []int{0, 1, aes.BlockSize, fileChunkSize - 1, fileChunkSize, 3*fileChunkSize + 7}
+	for _, size := range sizes {
+		plaintext := make([]byte, size)
+		if _, err := rand.Read(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		cbc, _ := base64.StdEncoding.DecodeString(encryptCBCForTest(t, plaintext, nil))
+		encrypted := map[string][]byte{
+			cipherCBC: cbc,
+			cipherGCM: encryptFileGCMForTest(t, plaintext),
+		}
+		for cipherName, ciphertext := range encrypted {
+			var out bytes.Buffer
+			if err := decryptFile(&out, bytes.NewReader(ciphertext), testAESKey, cipherName); err != nil {
+				t.Fatalf("%s: decryptFile(%d bytes) failed: %v", cipherName, size, err)
+			}
+			if !bytes.Equal(out.Bytes(), plaintext) {
+				t.Errorf("%s: decryptFile(%d bytes) returned %d different bytes", cipherName, size, out.Len())
+			}
+		}
+	}
+}
+
+func TestDecryptFileGCMRejectsTampering(t *testing.T) {
+	plaintext := make([]byte, 2*fileChunkSize+100)
+	sealed := encryptFileGCMForTest(t, plaintext)
+	record := fileChunkSize + 16
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	flipped := join(sealed)
+	flipped[100] ^= 1
+	tests := []struct {
+		name       string
+		ciphertext []byte
+	}{
+		{"flipped bit", flipped},
+		{"final record dropped", sealed[:12+2*record]},
+		{"cut mid record", sealed[:12+record+50]},
+		{"records swapped", join(sealed[:12], sealed[12+record:12+2*record], sealed[12:12+record], sealed[12+2*record:])},
+		{"nonce only", sealed[:12]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := decryptFile(io.Discard, bytes.NewReader(tt.ciphertext), testAESKey, cipherGCM); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -16,6 +16,10 @@ func initSpecialDB[T any](dbPath string) *gorm.DB {
 		logger.Fatal("Failed to connect database: "+dbPath+" with error :", zap.Error(err))
 		panic("failed to connect database:" + dbPath)
 	}
+	// SQLite allows a single writer; the delivery workers share this handle.
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.SetMaxOpenConns(1)
+	}
 	// Migrate the schema
 	var t T
 	db.AutoMigrate(&t)
@@ -23,7 +27,22 @@ func initSpecialDB[T any](dbPath string) *gorm.DB {
 	return db
 }
 
+// migrateDB creates the tables that live next to the subscriptions.
+func migrateDB(db *gorm.DB) error {
+	return db.AutoMigrate(&Delivery{}, &AlbumItem{}, &NotificationCallback{}, &SentMessage{}, &Token{}, &Topic{}, &TopicMember{}, &IdempotencyKey{}, &AlertGroup{})
+}
+
+// saveSubscription writes every field of subscription back. Subscriptions
+// have no primary key, so db.Save cannot tell which row to update.
+func saveSubscription(subscription *Subscription) error {
+	return db.Model(&Subscription{}).Where("chat_id = ?", subscription.ChatID).Select("*").Updates(subscription).Error
+}
+
 func initDB() {
 	db = initSpecialDB[Subscription](*db_path)
+	if err := migrateDB(db); err != nil {
+		logger.Fatal("Failed to migrate database: "+*db_path, zap.Error(err))
+		panic(err)
+	}
 	article_db = initSpecialDB[Article](*article_db_path)
 }
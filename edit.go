@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+// deliveryWaitTimeout bounds how long a send endpoint called with wait waits
+// for its delivery to be sent.
+const deliveryWaitTimeout = 10 * time.Second
+
+// editError is returned when a delivery cannot be edited or deleted, with
+// the status the request is answered with.
+type editError struct {
+	status  int
+	message string
+}
+
+func (e *editError) Error() string {
+	return e.message
+}
+
+func editFailure(status int, format string, args ...interface{}) *editError {
+	return &editError{status, fmt.Sprintf(format, args...)}
+}
+
+// waitForDelivery waits until the delivery with id is sent or has failed, or
+// until timeout, and returns its state at that point. Deliveries that are
+// held or scheduled for later are not waited for.
+func waitForDelivery(id uint, timeout time.Duration) Delivery {
+	deadline := time.Now().Add(timeout)
+	var delivery Delivery
+	for {
+		db.First(&delivery, id)
+		if (delivery.Status != deliveryQueued && delivery.Status != deliverySending) || time.Now().After(deadline) {
+			return delivery
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// sentMessages returns the Telegram messages sent for delivery in order.
+func sentMessages(delivery *Delivery) ([]SentMessage, error) {
+	var sent []SentMessage
+	err := db.Where("delivery_id = ?", delivery.ID).Order("part").Find(&sent).Error
+	return sent, err
+}
+
+// isNotModified reports whether Telegram refused an edit because it would
+// not change the message, which is what the edit wanted anyway.
+func isNotModified(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "message is not modified")
+}
+
+// isMessageGone reports whether Telegram refused to delete a message that
+// was already deleted.
+func isMessageGone(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "message to delete not found")
+}
+
+// editDelivery replaces the text of a sent text delivery, or the caption of
+// a sent file. A text is rendered in format and overflow like a new message
+// and has to fit into the messages that were sent for it; messages it no
+// longer needs are deleted. The keyboard of the message is kept.
+func editDelivery(delivery *Delivery, text string, format string, overflow string) error {
+	if delivery.Status != deliverySent {
+		return editFailure(http.StatusConflict, "Message is %s, only sent messages can be edited", delivery.Status)
+	}
+	sent, err := sentMessages(delivery)
+	if err != nil {
+		return err
+	}
+	if len(sent) == 0 {
+		return editFailure(http.StatusConflict, "No sent message found")
+	}
+	switch delivery.Kind {
+	case deliveryKindText:
+		if err := editText(delivery, sent, text, format, overflow); err != nil {
+			return err
+		}
+		delivery.Format = format
+		delivery.Overflow = overflow
+	case deliveryKindFile:
+		if utf16Length(text) > telegramCaptionLimit {
+			return editFailure(http.StatusBadRequest, "Caption is longer than %d characters", telegramCaptionLimit)
+		}
+		edit := tgbotapi.NewEditMessageCaption(delivery.ChatID, sent[0].MessageID, text)
+		if _, err := send(delivery.ChatID, edit); err != nil && !isNotModified(err) {
+			return err
+		}
+	default:
+		return editFailure(http.StatusBadRequest, "Albums cannot be edited")
+	}
+	delivery.Text = text
+	return db.Model(&Delivery{}).Where("id = ?", delivery.ID).Updates(map[string]interface{}{"text": delivery.Text, "format": delivery.Format, "overflow": delivery.Overflow}).Error
+}
+
+func editText(delivery *Delivery, sent []SentMessage, text string, format string, overflow string) error {
+	// Pages of server-html messages keep their link, only their text changes.
+	if err := article_db.Model(&Article{}).Where("uuid = ?", delivery.UUID).Update("markdown_text", text).Error; err != nil {
+		return err
+	}
+	parts, parseMode, err := renderMessage(text, format, overflow, delivery.UUID)
+	if err != nil {
+		return err
+	}
+	if len(parts) > len(sent) {
+		return editFailure(http.StatusBadRequest, "Edited message needs %d messages, but only %d were sent", len(parts), len(sent))
+	}
+	buttons := delivery.Buttons
+	var answered int64
+	db.Model(&NotificationCallback{}).Where("delivery_id = ? AND answered_at IS NOT NULL", delivery.ID).Count(&answered)
+	if answered > 0 {
+		buttons = urlButtons(buttons)
+	}
+	for i, part := range parts {
+		edit := tgbotapi.NewEditMessageText(delivery.ChatID, sent[i].MessageID, part)
+		edit.ParseMode = parseMode
+		edit.DisableWebPagePreview = delivery.DisablePreview
+		if i == len(parts)-1 {
+			edit.ReplyMarkup = inlineKeyboard(buttons)
+		}
+		if _, err := send(delivery.ChatID, edit); err != nil && !isNotModified(err) {
+			return err
+		}
+	}
+	for _, message := range sent[len(parts):] {
+		if err := request(delivery.ChatID, tgbotapi.NewDeleteMessage(delivery.ChatID, message.MessageID)); err != nil && !isMessageGone(err) {
+			return err
+		}
+		db.Delete(&message)
+	}
+	delivery.Parts = len(parts)
+	return db.Model(&Delivery{}).Where("id = ?", delivery.ID).Update("parts", delivery.Parts).Error
+}
+
+// deleteDelivery removes the messages sent for delivery from the chat. A
+// delivery still waiting in the queue, for quiet hours to end or for its
+// scheduled time, is dropped instead.
+func deleteDelivery(delivery *Delivery) error {
+	if delivery.Status == deliveryQueued || delivery.Status == deliveryHeld || delivery.Status == deliveryScheduled {
+		dropped := db.Model(&Delivery{}).Where("id = ? AND status = ?", delivery.ID, delivery.Status).Update("status", deliveryDeleted)
+		if dropped.Error != nil {
+			return dropped.Error
+		}
+		if dropped.RowsAffected == 1 {
+			delivery.Status = deliveryDeleted
+			removeDeliveryFiles(delivery)
+			return nil
+		}
+		db.First(delivery, delivery.ID)
+	}
+	switch delivery.Status {
+	case deliverySending:
+		return editFailure(http.StatusConflict, "Message is being sent, try again")
+	case deliveryDeleted:
+		return editFailure(http.StatusGone, "Message was already deleted")
+	}
+	sent, err := sentMessages(delivery)
+	if err != nil {
+		return err
+	}
+	for _, message := range sent {
+		if err := request(delivery.ChatID, tgbotapi.NewDeleteMessage(delivery.ChatID, message.MessageID)); err != nil && !isMessageGone(err) {
+			logger.Error("Failed to delete message", zap.String("delivery", delivery.UUID), zap.Int("message_id", message.MessageID), zap.Error(err))
+			return err
+		}
+		db.Delete(&message)
+	}
+	delivery.Status = deliveryDeleted
+	return db.Model(&Delivery{}).Where("id = ?", delivery.ID).Update("status", deliveryDeleted).Error
+}
+
+// respondEditError answers a failed edit or delete. Errors from Telegram,
+// e.g. for messages too old to be deleted, are passed on as 502.
+func respondEditError(c *gin.Context, realIP string, err error) {
+	status := http.StatusInternalServerError
+	var editErr *editError
+	var apiErr *tgbotapi.Error
+	if errors.As(err, &editErr) {
+		status = editErr.status
+	} else if errors.As(err, &apiErr) {
+		status = http.StatusBadGateway
+	}
+	logger.Error("Failed to change message for "+realIP, zap.Error(err))
+	c.JSON(status, gin.H{
+		"message": err.Error(),
+	})
+}
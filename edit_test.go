@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeleteQueuedDelivery(t *testing.T) {
+	openTestDB(t)
+	delivery := Delivery{ChatID: 1, Kind: deliveryKindText, Text: "Build 40%"}
+	if err := enqueueDelivery(&delivery); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteDelivery(&delivery); err != nil {
+		t.Fatalf("deleteDelivery() = %v", err)
+	}
+	var stored Delivery
+	db.First(&stored, delivery.ID)
+	if stored.Status != deliveryDeleted {
+		t.Errorf("status = %q, want %q", stored.Status, deliveryDeleted)
+	}
+	if pending := queue.due(); len(pending) != 0 {
+		t.Errorf("deleted delivery is still queued: %+v", pending)
+	}
+	var editErr *editError
+	if err := deleteDelivery(&stored); !errors.As(err, &editErr) || editErr.status != http.StatusGone {
+		t.Errorf("deleting twice = %v", err)
+	}
+}
+
+func TestEditUnsentDelivery(t *testing.T) {
+	openTestDB(t)
+	delivery := Delivery{ChatID: 1, Kind: deliveryKindText, Text: "Build 40%"}
+	if err := enqueueDelivery(&delivery); err != nil {
+		t.Fatal(err)
+	}
+	var editErr *editError
+	if err := editDelivery(&delivery, "Build 80%", "", ""); !errors.As(err, &editErr) || editErr.status != http.StatusConflict {
+		t.Errorf("editDelivery() of a queued message = %v", err)
+	}
+}
+
+func TestWaitForDelivery(t *testing.T) {
+	openTestDB(t)
+	delivery := Delivery{ChatID: 1, Kind: deliveryKindText, Text: "Build done"}
+	if err := enqueueDelivery(&delivery); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		db.Model(&Delivery{}).Where("id = ?", delivery.ID).Updates(map[string]interface{}{"status": deliverySent, "telegram_message_id": 42})
+	}()
+	waited := waitForDelivery(delivery.ID, 2*time.Second)
+	if waited.Status != deliverySent || waited.TelegramMessageID != 42 {
+		t.Errorf("waitForDelivery() = %q, %d", waited.Status, waited.TelegramMessageID)
+	}
+	if waited := waitForDelivery(delivery.ID+1, 0); waited.Status == deliverySent {
+		t.Errorf("waitForDelivery() of a missing delivery = %+v", waited)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// fetchError is returned when a file named by URL or local path cannot be
+// spooled, with the status the request is answered with.
+type fetchError struct {
+	status  int
+	message string
+}
+
+func (e *fetchError) Error() string {
+	return e.message
+}
+
+func fetchFailure(status int, format string, args ...interface{}) *fetchError {
+	return &fetchError{status, fmt.Sprintf(format, args...)}
+}
+
+func respondFetchError(c *gin.Context, realIP string, err error) {
+	status := http.StatusInternalServerError
+	var fetchErr *fetchError
+	if errors.As(err, &fetchErr) {
+		status = fetchErr.status
+	}
+	logger.Error("Failed to get file for "+realIP, zap.Error(err))
+	c.JSON(status, gin.H{
+		"message": err.Error(),
+	})
+}
+
+// hostAllowed reports whether files may be fetched from host.
+func hostAllowed(host string) bool {
+	return hostInList(host, config.FetchAllowedHosts)
+}
+
+// hostInList reports whether host is listed in hosts, either exactly or
+// below a "*." entry.
+func hostInList(host string, hosts []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range hosts {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchToSpool downloads rawURL into the spool. Only http and https URLs on
+// allowed hosts are fetched, redirects included, and the download is cut off
+// at fetch_max_size.
+func fetchToSpool(rawURL string) (string, string, error) {
+	if len(config.FetchAllowedHosts) == 0 {
+		return "", "", fetchFailure(http.StatusForbidden, "Fetching files by URL is disabled")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", "", fetchFailure(http.StatusBadRequest, "Invalid URL, must be http or https")
+	}
+	if !hostAllowed(u.Hostname()) {
+		return "", "", fetchFailure(http.StatusForbidden, "Fetching files from %s is not allowed", u.Hostname())
+	}
+	client := &http.Client{
+		Timeout: config.FetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fetchFailure(http.StatusBadGateway, "Too many redirects")
+			}
+			if !hostAllowed(req.URL.Hostname()) {
+				return fetchFailure(http.StatusForbidden, "Redirect to %s is not allowed", req.URL.Hostname())
+			}
+			return nil
+		},
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		var fetchErr *fetchError
+		if errors.As(err, &fetchErr) {
+			return "", "", fetchErr
+		}
+		logger.Error("Failed to fetch file from "+u.Hostname(), zap.Error(err))
+		return "", "", fetchFailure(http.StatusBadGateway, "Failed to fetch file from %s", u.Hostname())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fetchFailure(http.StatusBadGateway, "Fetching file from %s failed: %s", u.Hostname(), resp.Status)
+	}
+	if resp.ContentLength > config.FetchMaxSize {
+		return "", "", tooLarge()
+	}
+	spoolPath := newSpoolPath()
+	if err := spoolLimited(spoolPath, resp.Body); err != nil {
+		return "", "", err
+	}
+	return spoolPath, responseFileName(resp), nil
+}
+
+// responseFileName names a downloaded file after its Content-Disposition,
+// or after the last segment of the URL it was finally fetched from.
+func responseFileName(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(params["filename"])
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return "file"
+}
+
+// spoolLocalFile copies a file below one of local_file_dirs into the spool,
+// so that it can be changed or removed while the delivery waits.
+func spoolLocalFile(localPath string) (string, string, error) {
+	if len(config.LocalFileDirs) == 0 {
+		return "", "", fetchFailure(http.StatusForbidden, "Sending local files is disabled")
+	}
+	if !filepath.IsAbs(localPath) {
+		return "", "", fetchFailure(http.StatusBadRequest, "Path must be absolute: %s", localPath)
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(localPath))
+	if err != nil {
+		return "", "", fetchFailure(http.StatusBadRequest, "File not found: %s", localPath)
+	}
+	if !inLocalFileDirs(resolved) {
+		return "", "", fetchFailure(http.StatusForbidden, "Sending files from %s is not allowed", filepath.Dir(localPath))
+	}
+	file, err := os.Open(resolved)
+	if err != nil {
+		return "", "", fetchFailure(http.StatusBadRequest, "File not found: %s", localPath)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return "", "", fetchFailure(http.StatusBadRequest, "Not a regular file: %s", localPath)
+	}
+	if info.Size() > config.FetchMaxSize {
+		return "", "", tooLarge()
+	}
+	spoolPath := newSpoolPath()
+	if err := spoolLimited(spoolPath, file); err != nil {
+		return "", "", err
+	}
+	return spoolPath, filepath.Base(resolved), nil
+}
+
+// inLocalFileDirs reports whether the resolved path lies below one of the
+// configured local file directories.
+func inLocalFileDirs(resolved string) bool {
+	for _, dir := range config.LocalFileDirs {
+		dir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(dir, resolved)
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func tooLarge() *fetchError {
+	return fetchFailure(http.StatusRequestEntityTooLarge, "File is larger than %d bytes", config.FetchMaxSize)
+}
+
+// spoolLimited copies src to path, failing once it exceeds fetch_max_size.
+func spoolLimited(path string, src io.Reader) error {
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, io.LimitReader(src, config.FetchMaxSize+1))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > config.FetchMaxSize {
+		err = tooLarge()
+	} else if err != nil {
+		logger.Error("Failed to spool file", zap.Error(err))
+		err = fetchFailure(http.StatusBadGateway, "Failed to read file")
+	}
+	if err != nil {
+		removeSpoolFile(path)
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHostAllowed(t *testing.T) {
+	config.FetchAllowedHosts = []string{"grafana.example.org", "*.s3.amazonaws.com"}
+	t.Cleanup(func() { config.FetchAllowedHosts = nil })
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"grafana.example.org", true},
+		{"GRAFANA.example.org.", true},
+		{"evil.grafana.example.org", false},
+		{"bucket.s3.amazonaws.com", true},
+		{"s3.amazonaws.com", false},
+		{"evil-s3.amazonaws.com", false},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := hostAllowed(tt.host); got != tt.want {
+			t.Errorf("hostAllowed(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestFetchToSpool(t *testing.T) {
+	spoolDir = t.TempDir()
+	config.FetchMaxSize = 16
+	config.FetchTimeout = 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/render/panel.png":
+			w.Write([]byte("\x89PNG\r\n\x1a\n"))
+		case "/download":
+			w.Header().Set("Content-Disposition", `attachment; filename="../report.pdf"`)
+			w.Write([]byte("%PDF-1.4"))
+		case "/large":
+			w.Write([]byte(strings.Repeat("x", 17)))
+		case "/away":
+			http.Redirect(w, r, "http://elsewhere.invalid/", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	host := strings.Split(strings.TrimPrefix(server.URL, "http://"), ":")[0]
+	config.FetchAllowedHosts = []string{host}
+	t.Cleanup(func() { config.FetchAllowedHosts = nil })
+
+	tests := []struct {
+		path       string
+		wantName   string
+		wantStatus int
+	}{
+		{"/render/panel.png", "panel.png", 0},
+		{"/download", "report.pdf", 0},
+		{"/large", "", http.StatusRequestEntityTooLarge},
+		{"/away", "", http.StatusForbidden},
+		{"/missing", "", http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		spoolPath, name, err := fetchToSpool(server.URL + tt.path)
+		status := 0
+		if err != nil {
+			status = err.(*fetchError).status
+		}
+		if status != tt.wantStatus || name != tt.wantName {
+			t.Errorf("fetchToSpool(%s) = %q, %v, want %q, status %d", tt.path, name, err, tt.wantName, tt.wantStatus)
+		}
+		if err == nil {
+			if _, err := os.Stat(spoolPath); err != nil {
+				t.Errorf("fetchToSpool(%s) did not spool the file: %v", tt.path, err)
+			}
+		}
+	}
+	if entries, _ := os.ReadDir(spoolDir); len(entries) != 2 {
+		t.Errorf("spool has %d files, want 2", len(entries))
+	}
+
+	if _, _, err := fetchToSpool("file:///etc/passwd"); err == nil {
+		t.Error("fetched a file URL")
+	}
+	other, _ := url.Parse(server.URL)
+	other.Host = "localhost:" + other.Port()
+	if _, _, err := fetchToSpool(other.String() + "/render/panel.png"); err == nil {
+		t.Error("fetched from a host that is not allowed")
+	}
+}
+
+func TestSpoolLocalFile(t *testing.T) {
+	spoolDir = t.TempDir()
+	config.FetchMaxSize = 1 << 20
+	allowed := t.TempDir()
+	outside := t.TempDir()
+	config.LocalFileDirs = []string{allowed}
+	t.Cleanup(func() { config.LocalFileDirs = nil })
+	os.WriteFile(filepath.Join(allowed, "report.txt"), []byte("report"), 0o600)
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0o600)
+	os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(allowed, "link.txt"))
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{filepath.Join(allowed, "report.txt"), 0},
+		{filepath.Join(allowed, "..", filepath.Base(outside), "secret.txt"), http.StatusForbidden},
+		{filepath.Join(allowed, "link.txt"), http.StatusForbidden},
+		{filepath.Join(allowed, "missing.txt"), http.StatusBadRequest},
+		{allowed, http.StatusForbidden},
+		{"report.txt", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		spoolPath, name, err := spoolLocalFile(tt.path)
+		status := 0
+		if err != nil {
+			status = err.(*fetchError).status
+		}
+		if status != tt.wantStatus {
+			t.Errorf("spoolLocalFile(%s) = %v, want status %d", tt.path, err, tt.wantStatus)
+			continue
+		}
+		if err == nil {
+			content, _ := os.ReadFile(spoolPath)
+			if name != "report.txt" || string(content) != "report" {
+				t.Errorf("spoolLocalFile(%s) = %q with %q", tt.path, name, content)
+			}
+		}
+	}
+}
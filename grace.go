@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// inGracePeriod reports whether the credentials replaced by the last
+// /regenerate of subscription are still accepted.
+func inGracePeriod(subscription *Subscription) bool {
+	return subscription.PreviousExpiresAt != nil && time.Now().Before(*subscription.PreviousExpiresAt)
+}
+
+// rotateCredentials replaces the UUID and AES key of subscription. The old
+// ones keep working for grace, or stop working at once if grace is zero;
+// ownerID is reminded before the grace period ends.
+func rotateCredentials(subscription *Subscription, uuidStr string, aesKey string, grace time.Duration, ownerID int64) {
+	if grace > 0 {
+		expiresAt := time.Now().Add(grace)
+		subscription.PreviousUUID = subscription.UUID
+		subscription.PreviousAESKey = subscription.AESKey
+		subscription.PreviousSigningSecret = subscription.SigningSecret
+		subscription.PreviousExpiresAt = &expiresAt
+		subscription.GraceOwnerID = ownerID
+		subscription.GraceReminded = false
+	} else {
+		clearPreviousCredentials(subscription)
+	}
+	subscription.UUID = uuidStr
+	subscription.AESKey = aesKey
+}
+
+func clearPreviousCredentials(subscription *Subscription) {
+	subscription.PreviousUUID = ""
+	subscription.PreviousAESKey = ""
+	subscription.PreviousSigningSecret = ""
+	subscription.PreviousExpiresAt = nil
+	subscription.GraceOwnerID = 0
+	subscription.GraceReminded = false
+}
+
+// errAmbiguousKey is returned when a CBC message decrypts with both the
+// current and the replaced AES key, so the key it was encrypted with is
+// unknown.
+var errAmbiguousKey = errors.New("message decrypts with both the current and the replaced AES key")
+
+// decryptForSubscription decrypts a message with the AES key of subscription
+// or, during the grace period, with the key it replaced. It also returns the
+// key that worked, so the rest of the request can be decrypted with it.
+//
+// GCM authenticates the ciphertext, so only the right key decrypts it. CBC
+// only checks the padding, which a wrong key passes about once in 256 tries,
+// so a CBC message is tried with both keys and rejected if both work.
+func decryptForSubscription(subscription *Subscription, encrypted string, cipherName string) (string, string, error) {
+	text, err := decryptMessage(encrypted, subscription.AESKey, cipherName)
+	if !inGracePeriod(subscription) || subscription.PreviousAESKey == "" || (err == nil && cipherName == cipherGCM) {
+		if err != nil {
+			return "", "", err
+		}
+		return text, subscription.AESKey, nil
+	}
+	previousText, previousErr := decryptMessage(encrypted, subscription.PreviousAESKey, cipherName)
+	switch {
+	case err == nil && previousErr == nil:
+		return "", "", errAmbiguousKey
+	case err == nil:
+		return text, subscription.AESKey, nil
+	case previousErr == nil:
+		subscription.usedPreviousCredentials = true
+		return previousText, subscription.PreviousAESKey, nil
+	}
+	return "", "", err
+}
+
+// withGraceWarning adds a footer to text if the request was authenticated
+// with replaced credentials, so the owner notices the client still uses them.
+func withGraceWarning(subscription *Subscription, text string) string {
+	if !subscription.usedPreviousCredentials || subscription.PreviousExpiresAt == nil {
+		return text
+	}
+	warning := "⚠️ Sent with a UUID or AES key replaced by /regenerate. It stops working at " + subscription.PreviousExpiresAt.UTC().Format(time.RFC3339) + ", please update this client."
+	if text == "" {
+		return warning
+	}
+	return text + "\n\n" + warning
+}
+
+func startGraceReminders() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			remindGracePeriods(now)
+		}
+	}()
+}
+
+// remindGracePeriods tells the owners of subscriptions whose grace period
+// ends within the reminder time, and forgets the replaced credentials once
+// the grace period is over.
+func remindGracePeriods(now time.Time) {
+	var subscriptions []Subscription
+	if err := db.Where("previous_expires_at IS NOT NULL AND grace_reminded = ? AND previous_expires_at <= ?", false, now.Add(config.RegenerateReminder)).Find(&subscriptions).Error; err != nil {
+		logger.Error("Failed to load grace periods", zap.Error(err))
+		return
+	}
+	for _, subscription := range subscriptions {
+		if subscription.PreviousExpiresAt.After(now) {
+			ownerID := subscription.GraceOwnerID
+			if ownerID == 0 {
+				ownerID = subscription.ChatID
+			}
+			text := "The UUID and AES key replaced by /regenerate"
+			if subscription.ChatID != ownerID {
+				text += " for chat " + strconv.FormatInt(subscription.ChatID, 10)
+			}
+			text += " stop working at " + subscription.PreviousExpiresAt.UTC().Format(time.RFC3339) + ". Clients that still use them will fail; use /info to get the new ones."
+			if _, err := sendText(ownerID, text); err != nil {
+				logger.Error("Failed to send grace period reminder", zap.Int64("chatID", subscription.ChatID), zap.Error(err))
+				continue
+			}
+		}
+		db.Model(&Subscription{}).Where("chat_id = ?", subscription.ChatID).Update("grace_reminded", true)
+	}
+	if err := db.Model(&Subscription{}).Where("previous_expires_at <= ?", now).Updates(map[string]interface{}{
+		"previous_uuid":           "",
+		"previous_aes_key":        "",
+		"previous_signing_secret": "",
+		"previous_expires_at":     nil,
+		"grace_owner_id":          0,
+		"grace_reminded":          false,
+	}).Error; err != nil {
+		logger.Error("Failed to clear expired credentials", zap.Error(err))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newUUIDContext(uuidStr string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+	c.Params = gin.Params{{Key: "uuid", Value: uuidStr}}
+	return c
+}
+
+func TestCheckAuthorizationDuringGracePeriod(t *testing.T) {
+	openTestDB(t)
+	subscription := Subscription{ChatID: 1, UUID: "old", AESKey: testAESKey, ReceiveMsgs: true}
+	db.Create(&subscription)
+	rotateCredentials(&subscription, "new", "ff", time.Hour, 1)
+	if err := saveSubscription(&subscription); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := checkAuthorization(newUUIDContext("new"))
+	if err != nil || got.usedPreviousCredentials {
+		t.Fatalf("checkAuthorization(new) = %+v, %v", got, err)
+	}
+	got, err = checkAuthorization(newUUIDContext("old"))
+	if err != nil || !got.usedPreviousCredentials {
+		t.Fatalf("checkAuthorization(old) = %+v, %v", got, err)
+	}
+
+	db.Model(&Subscription{}).Where("chat_id = ?", 1).Update("previous_expires_at", time.Now().Add(-time.Minute))
+	if _, err := checkAuthorization(newUUIDContext("old")); err != errNotSubscribed {
+		t.Errorf("checkAuthorization(old) after grace period = %v, want %v", err, errNotSubscribed)
+	}
+}
+
+func TestDecryptForSubscriptionWithPreviousKey(t *testing.T) {
+	encrypted := encryptCBCForTest(t, []byte("hello"), nil)
+	newKey, _ := generateRandomAESKey()
+	subscription := &Subscription{AESKey: testAESKey}
+	rotateCredentials(subscription, "new", newKey, time.Hour, 1)
+
+	text, key, err := decryptForSubscription(subscription, encrypted, cipherCBC)
+	if err != nil || text != "hello" || key != testAESKey {
+		t.Fatalf("decryptForSubscription() = %q, %q, %v", text, key, err)
+	}
+	if !subscription.usedPreviousCredentials {
+		t.Error("previous key not flagged")
+	}
+	if got := withGraceWarning(subscription, text); !strings.HasPrefix(got, "hello\n\n⚠️") {
+		t.Errorf("withGraceWarning() = %q", got)
+	}
+
+	subscription = &Subscription{AESKey: testAESKey}
+	rotateCredentials(subscription, "new", newKey, 0, 1)
+	if _, _, err := decryptForSubscription(subscription, encrypted, cipherCBC); err == nil {
+		t.Error("previous key accepted without a grace period")
+	}
+}
+
+func TestDecryptForSubscriptionRejectsAmbiguousKey(t *testing.T) {
+	encrypted := encryptCBCForTest(t, []byte("hello"), nil)
+	// Find a new key under which the message still has valid padding.
+	var newKey string
+	for i := 0; i < 100000 && newKey == ""; i++ {
+		key, _ := generateRandomAESKey()
+		if _, err := decryptMessage(encrypted, key, cipherCBC); err == nil {
+			newKey = key
+		}
+	}
+	if newKey == "" {
+		t.Fatal("no key found that decrypts the message")
+	}
+	subscription := &Subscription{AESKey: testAESKey}
+	rotateCredentials(subscription, "new", newKey, time.Hour, 1)
+
+	if text, _, err := decryptForSubscription(subscription, encrypted, cipherCBC); err != errAmbiguousKey {
+		t.Errorf("decryptForSubscription() = %q, %v, want %v", text, err, errAmbiguousKey)
+	}
+}
+
+func TestRemindGracePeriodsClearsExpiredCredentials(t *testing.T) {
+	openTestDB(t)
+	expired := time.Now().Add(-time.Minute)
+	db.Create(&Subscription{ChatID: 1, UUID: "new", PreviousUUID: "old", PreviousAESKey: testAESKey, PreviousExpiresAt: &expired, GraceReminded: true})
+
+	remindGracePeriods(time.Now())
+
+	var subscription Subscription
+	db.First(&subscription, "chat_id = ?", 1)
+	if subscription.PreviousUUID != "" || subscription.PreviousAESKey != "" || subscription.PreviousExpiresAt != nil {
+		t.Errorf("previous credentials kept: %+v", subscription)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// defaultGroupWindow is how long a group collects repeats unless the message
+// gives its group_window.
+const defaultGroupWindow = 5 * time.Minute
+
+// maxGroupWindow bounds the group_window of a message.
+const maxGroupWindow = 24 * time.Hour
+
+// messageGroupWindow returns how long the group of msg collects repeats.
+func messageGroupWindow(msg *Message) (time.Duration, error) {
+	if msg.GroupKey == "" {
+		if msg.GroupWindow != "" {
+			return 0, fmt.Errorf("group_window needs a group_key")
+		}
+		return 0, nil
+	}
+	if len(msg.GroupKey) > maxIdempotencyKeyLength {
+		return 0, fmt.Errorf("group_key must be at most %d characters", maxIdempotencyKeyLength)
+	}
+	if msg.SendAt != "" || msg.Delay != "" {
+		return 0, fmt.Errorf("group_key cannot be combined with send_at or delay")
+	}
+	if msg.GroupWindow == "" {
+		return defaultGroupWindow, nil
+	}
+	window, err := time.ParseDuration(msg.GroupWindow)
+	if err != nil || window < time.Second || window > maxGroupWindow {
+		return 0, fmt.Errorf("group_window must be a duration between 1s and 24h, e.g. 5m")
+	}
+	return window, nil
+}
+
+// repeatInGroup counts a repeat of the message with key in the open group of
+// chatID and returns the first message of the group, or nil if no group is
+// open.
+func repeatInGroup(chatID int64, key string, now time.Time) (*Delivery, error) {
+	var group AlertGroup
+	err := db.Where("chat_id = ? AND key = ? AND closes_at > ?", chatID, key, now).Order("id").First(&group).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Model(&AlertGroup{}).Where("id = ?", group.ID).Updates(map[string]interface{}{"count": gorm.Expr("count + 1"), "last_at": now}).Error; err != nil {
+		return nil, err
+	}
+	var delivery Delivery
+	if err := db.First(&delivery, group.DeliveryID).Error; err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// openGroup starts collecting the repeats of delivery, sent with key, for
+// window.
+func openGroup(key string, delivery *Delivery, window time.Duration) error {
+	now := time.Now()
+	group := AlertGroup{ChatID: delivery.ChatID, Key: key, DeliveryID: delivery.ID, Count: 1, ShownCount: 1, FirstAt: now, LastAt: now, ClosesAt: now.Add(window)}
+	return db.Create(&group).Error
+}
+
+func startAlertGroups() {
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			updateAlertGroups(now)
+		}
+	}()
+}
+
+// updateAlertGroups shows the number of repeats in the first message of
+// every group that was repeated since it was last updated, and closes the
+// groups whose window has ended.
+func updateAlertGroups(now time.Time) {
+	var groups []AlertGroup
+	if err := db.Where("count <> shown_count OR closes_at <= ?", now).Order("id").Find(&groups).Error; err != nil {
+		logger.Error("Failed to load alert groups", zap.Error(err))
+		return
+	}
+	for _, group := range groups {
+		var delivery Delivery
+		if err := db.First(&delivery, group.DeliveryID).Error; err != nil {
+			logger.Error("Failed to load delivery of alert group", zap.Uint("id", group.DeliveryID), zap.Error(err))
+			db.Delete(&group)
+			continue
+		}
+		if group.Count != group.ShownCount {
+			showRepeats(&delivery, &group)
+		}
+		if !group.ClosesAt.After(now) {
+			closeGroup(&delivery, &group)
+		}
+	}
+}
+
+// repeatsLine is the line the first message of group ends with.
+func repeatsLine(group *AlertGroup, location *time.Location) string {
+	return "×" + strconv.Itoa(group.Count) + ", last at " + group.LastAt.In(location).Format("15:04")
+}
+
+// showRepeats edits the first message of group to show how often it was
+// repeated. Messages that are not sent yet are edited once they are, and
+// edits that fail for the time being, e.g. under flood control, are retried
+// on the next update.
+func showRepeats(delivery *Delivery, group *AlertGroup) {
+	switch delivery.Status {
+	case deliveryQueued, deliverySending, deliveryHeld:
+		return
+	case deliverySent:
+		if delivery.Kind != deliveryKindText {
+			break
+		}
+		sent, err := sentMessages(delivery)
+		if err != nil || len(sent) == 0 {
+			break
+		}
+		var subscription Subscription
+		db.First(&subscription, "chat_id = ?", delivery.ChatID)
+		text := delivery.Text + "\n\n" + repeatsLine(group, subscriptionLocation(&subscription))
+		if err := editText(delivery, sent, text, delivery.Format, delivery.Overflow); err != nil {
+			logger.Error("Failed to show repeats", zap.String("delivery", delivery.UUID), zap.Error(err))
+			var editErr *editError
+			if !isPermanentSendError(err) && !errors.As(err, &editErr) {
+				return
+			}
+		}
+	}
+	group.ShownCount = group.Count
+	db.Model(&AlertGroup{}).Where("id = ?", group.ID).Update("shown_count", group.ShownCount)
+}
+
+// closeGroup ends group and, if its message was repeated, queues a summary
+// in reply to its first message. There is no summary if the first message
+// failed or was deleted.
+func closeGroup(delivery *Delivery, group *AlertGroup) {
+	if group.Count > 1 && delivery.Status != deliveryFailed && delivery.Status != deliveryDeleted {
+		var subscription Subscription
+		db.First(&subscription, "chat_id = ?", delivery.ChatID)
+		location := subscriptionLocation(&subscription)
+		header := fmt.Sprintf("Repeated %d times from %s to %s", group.Count, group.FirstAt.In(location).Format("15:04"), group.LastAt.In(location).Format("15:04"))
+		summary := Delivery{
+			ChatID:           delivery.ChatID,
+			Kind:             deliveryKindText,
+			Format:           delivery.Format,
+			Overflow:         delivery.Overflow,
+			Text:             emphasize(header, delivery.Format) + "\n\n" + delivery.Text,
+			ThreadID:         delivery.ThreadID,
+			ReplyToMessageID: delivery.TelegramMessageID,
+			Silent:           delivery.Silent,
+			ProtectContent:   delivery.ProtectContent,
+			DisablePreview:   delivery.DisablePreview,
+			Priority:         delivery.Priority,
+		}
+		if err := enqueueDelivery(&summary); err != nil {
+			logger.Error("Failed to queue alert group summary", zap.String("delivery", delivery.UUID), zap.Error(err))
+			return
+		}
+	}
+	if err := db.Delete(group).Error; err != nil {
+		logger.Error("Failed to close alert group", zap.Uint("id", group.ID), zap.Error(err))
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertGroup(t *testing.T) {
+	openTestDB(t)
+	db.Create(&Subscription{ChatID: 1, UUID: "u1", ReceiveMsgs: true})
+
+	post := func(body string) string {
+		w, id := serveTest(handleJSON, http.MethodPost, "/api/:uuid/json", "/api/u1/json", body, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request answered %d: %s", w.Code, w.Body)
+		}
+		return id
+	}
+
+	first := post(`{"msg": "check_http is flapping", "group_key": "check_http", "group_window": "1m"}`)
+	for i := 0; i < 2; i++ {
+		if repeat := post(`{"msg": "check_http is flapping", "group_key": "check_http", "group_window": "1m"}`); repeat != first {
+			t.Errorf("repeat got %q, want %q", repeat, first)
+		}
+	}
+	if other := post(`{"msg": "check_disk is flapping", "group_key": "check_disk"}`); other == first {
+		t.Error("another group key was grouped")
+	}
+	var group AlertGroup
+	db.Where("key = ?", "check_http").First(&group)
+	if group.Count != 3 {
+		t.Errorf("count = %d, want 3", group.Count)
+	}
+
+	// The first message is not sent yet, so closing the group only queues
+	// the summary.
+	updateAlertGroups(group.ClosesAt)
+	var deliveries []Delivery
+	db.Order("id").Find(&deliveries)
+	if len(deliveries) != 3 || !strings.Contains(deliveries[2].Text, "Repeated 3 times") || !strings.Contains(deliveries[2].Text, "check_http is flapping") {
+		t.Fatalf("deliveries = %+v", deliveries)
+	}
+	var open int64
+	db.Model(&AlertGroup{}).Where("key = ?", "check_http").Count(&open)
+	if open != 0 {
+		t.Error("group is still open")
+	}
+	if next := post(`{"msg": "check_http is flapping", "group_key": "check_http"}`); next == first {
+		t.Error("message after the window was grouped")
+	}
+}
+
+func TestShowRepeats(t *testing.T) {
+	openTestDB(t)
+	previous := article_db
+	article_db = initSpecialDB[Article](":memory:")
+	t.Cleanup(func() { article_db = previous })
+	form := fakeTelegram(t, `{"message_id": 42, "chat": {"id": 1}}`)
+	delivery := Delivery{ChatID: 1, Kind: deliveryKindText, Text: "check_http is flapping"}
+	enqueueDelivery(&delivery)
+	db.Model(&delivery).Updates(map[string]interface{}{"status": deliverySent, "telegram_message_id": 42})
+	db.Create(&SentMessage{DeliveryID: delivery.ID, ChatID: 1, MessageID: 42})
+	db.First(&delivery, delivery.ID)
+
+	lastAt := time.Date(2025, 5, 1, 12, 4, 0, 0, time.UTC)
+	group := AlertGroup{ChatID: 1, Key: "check_http", DeliveryID: delivery.ID, Count: 37, ShownCount: 1, LastAt: lastAt, ClosesAt: time.Now().Add(time.Minute)}
+	db.Create(&group)
+	updateAlertGroups(time.Now())
+
+	if text := form.Get("text"); !strings.Contains(text, "check_http is flapping") || !strings.Contains(text, "×37, last at 12:04") || form.Get("message_id") != "42" {
+		t.Errorf("edit = %v", *form)
+	}
+	db.First(&group, group.ID)
+	if group.ShownCount != 37 {
+		t.Errorf("shown count = %d, want 37", group.ShownCount)
+	}
+}
+
+func TestShowRepeatsRetriesFloodControl(t *testing.T) {
+	openTestDB(t)
+	testQueueConfig(t, 8)
+	previous := article_db
+	article_db = initSpecialDB[Article](":memory:")
+	t.Cleanup(func() { article_db = previous })
+	fakeTelegramResponse(t, `{"ok": false, "error_code": 429, "description": "Too Many Requests: retry after 1", "parameters": {"retry_after": 1}}`)
+	delivery := Delivery{ChatID: 1, Kind: deliveryKindText, Text: "check_http is flapping"}
+	enqueueDelivery(&delivery)
+	db.Model(&delivery).Updates(map[string]interface{}{"status": deliverySent, "telegram_message_id": 42})
+	db.Create(&SentMessage{DeliveryID: delivery.ID, ChatID: 1, MessageID: 42})
+	db.First(&delivery, delivery.ID)
+
+	group := AlertGroup{ChatID: 1, Key: "check_http", DeliveryID: delivery.ID, Count: 5, ShownCount: 1, LastAt: time.Now(), ClosesAt: time.Now().Add(time.Minute)}
+	db.Create(&group)
+	showRepeats(&delivery, &group)
+	db.First(&group, group.ID)
+	if group.ShownCount != 1 {
+		t.Errorf("shown count = %d after a failed edit, want 1", group.ShownCount)
+	}
+}
+
+func TestCloseGroupOfDeletedMessage(t *testing.T) {
+	openTestDB(t)
+	for _, status := range []string{deliveryDeleted, deliveryFailed} {
+		delivery := Delivery{ChatID: 1, Kind: deliveryKindText, Text: "check_http is flapping"}
+		enqueueDelivery(&delivery)
+		db.Model(&delivery).Update("status", status)
+		group := AlertGroup{ChatID: 1, Key: "check_http", DeliveryID: delivery.ID, Count: 3, ShownCount: 3, ClosesAt: time.Now()}
+		db.Create(&group)
+
+		updateAlertGroups(time.Now())
+		var count int64
+		db.Model(&Delivery{}).Where("chat_id = ? AND status = ?", 1, deliveryQueued).Count(&count)
+		if count != 0 {
+			t.Errorf("queued a summary for a %s message", status)
+		}
+		db.Model(&AlertGroup{}).Where("id = ?", group.ID).Count(&count)
+		if count != 0 {
+			t.Errorf("group of a %s message is still open", status)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"mime/multipart"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -12,8 +15,8 @@ import (
 func enableCors() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, PUT, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, PUT, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Signature, X-Timestamp")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusOK)
 			return
@@ -31,187 +34,826 @@ func getRealIP(c *gin.Context) string {
 	return realIP
 }
 
-func checkAuthorization(c *gin.Context) (bool, *Subscription) {
+// checkAuthorization looks up the subscription named in the URL, either by
+// its UUID, by the UUID it replaced during the grace period or by one of its
+// active API tokens, and, if the request is signed or the subscription
+// requires it, checks the signature.
+func checkAuthorization(c *gin.Context) (*Subscription, error) {
 	uuidStr := c.Param("uuid")
 	var subscription Subscription
 	db.First(&subscription, "uuid = ?", uuidStr)
-	if subscription.UUID != "" {
-		if subscription.ReceiveMsgs {
-			return true, &subscription
-		} else {
-			return false, nil
+	if subscription.UUID == "" {
+		if db.First(&subscription, "previous_uuid = ? AND previous_expires_at > ?", uuidStr, time.Now()).Error == nil {
+			subscription.usedPreviousCredentials = true
+		}
+	}
+	if subscription.UUID == "" {
+		if token, ok := lookupToken(uuidStr); ok {
+			db.First(&subscription, "chat_id = ?", token.ChatID)
+			subscription.tokenThreadID = token.ThreadID
+		}
+	}
+	if subscription.UUID == "" || !subscription.ReceiveMsgs {
+		return nil, errNotSubscribed
+	}
+	if err := verifySignature(c, &subscription); err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// checkMessage validates the fields of a text message that do not depend on
+// the chat it is sent to.
+func checkMessage(msg *Message) error {
+	if msg.Msg == "" {
+		return fmt.Errorf("Invalid message")
+	}
+	if !isValidOverflow(msg.Overflow) {
+		return fmt.Errorf("Invalid overflow, must be split, server-html or truncate")
+	}
+	if !isValidCipher(msg.Cipher) {
+		return fmt.Errorf("Invalid cipher, must be cbc or gcm")
+	}
+	if msg.Webhook != "" {
+		if err := checkWebhookURL(msg.Webhook); err != nil {
+			return fmt.Errorf("Invalid webhook: %w", err)
+		}
+	}
+	if err := checkButtons(msg.Buttons, msg.Webhook != ""); err != nil {
+		return fmt.Errorf("Invalid buttons: %w", err)
+	}
+	if !isValidPriority(msg.Priority) {
+		return fmt.Errorf("Invalid priority, must be normal or high")
+	}
+	if _, err := messageSendAt(msg, time.Now()); err != nil {
+		return fmt.Errorf("Invalid schedule: %w", err)
+	}
+	if _, err := messageGroupWindow(msg); err != nil {
+		return fmt.Errorf("Invalid group: %w", err)
+	}
+	return nil
+}
+
+// newTextDelivery builds the delivery of msg, decrypted to text, to chatID,
+// together with the callbacks of its buttons.
+func newTextDelivery(chatID int64, msg *Message, text string, threadID int) (Delivery, error) {
+	// The buttons get callback IDs of their own for every chat.
+	var buttons [][]Button
+	for _, row := range msg.Buttons {
+		buttons = append(buttons, append([]Button(nil), row...))
+	}
+	delivery := Delivery{ChatID: chatID, Kind: deliveryKindText, Format: msg.Format, Overflow: msg.Overflow, Text: text, Buttons: buttons, CorrelationKey: msg.CorrelationKey, ThreadID: threadID, ReplyToMessageID: msg.ReplyToMessageID, Silent: msg.Silent, ProtectContent: msg.ProtectContent, DisablePreview: msg.DisablePreview, Priority: msg.Priority}
+	// checkMessage made sure the schedule is valid.
+	delivery.SendAt, _ = messageSendAt(msg, time.Now())
+	callbacks, err := prepareCallbacks(delivery.Buttons, chatID, msg.Webhook)
+	if err != nil {
+		return delivery, err
+	}
+	delivery.Callbacks = callbacks
+	return delivery, nil
+}
+
+// sendError is returned when a message cannot be queued, with the status
+// the request is answered with.
+type sendError struct {
+	status  int
+	message string
+}
+
+func (e *sendError) Error() string {
+	return e.message
+}
+
+// prepareMessage checks a message received by one of the send endpoints and
+// builds its delivery to the chat of subscription.
+func prepareMessage(realIP string, subscription *Subscription, msg *Message) (Delivery, error) {
+	if err := checkMessage(msg); err != nil {
+		logger.Error("Invalid message from "+realIP, zap.Error(err))
+		return Delivery{}, &sendError{http.StatusBadRequest, err.Error()}
+	}
+	threadID, err := resolveThread(subscription, msg.ThreadID, msg.ReplyToMessageID)
+	if err != nil {
+		return Delivery{}, &sendError{http.StatusBadRequest, "Invalid placement: " + err.Error()}
+	}
+	text := msg.Msg
+	if msg.Encrypted {
+		decrypted, _, err := decryptForSubscription(subscription, msg.Msg, msg.Cipher)
+		if err != nil {
+			logger.Error("Failed to decrypt message from "+realIP, zap.Error(err))
+			return Delivery{}, &sendError{http.StatusBadRequest, "Failed to decrypt message"}
 		}
+		text = decrypted
 	} else {
-		return false, nil
+		logger.Info("Received message: " + msg.Msg)
+	}
+	delivery, err := newTextDelivery(subscription.ChatID, msg, withGraceWarning(subscription, text), threadID)
+	if err != nil {
+		logger.Error("Failed to prepare callbacks", zap.Error(err))
+		return Delivery{}, &sendError{http.StatusInternalServerError, "Failed to queue message"}
+	}
+	return delivery, nil
+}
+
+// queueOutcome tells how enqueueMessage handled a message.
+type queueOutcome int
+
+const (
+	// The message was queued, or scheduled, as a new delivery.
+	outcomeQueued queueOutcome = iota
+	// The request was made before with the same idempotency key.
+	outcomeReplayed
+	// The message repeats one whose group is still open.
+	outcomeGrouped
+)
+
+// enqueueMessage prepares msg and stores it in the delivery queue. With an
+// idempotency key, the delivery of an earlier request with the same key is
+// returned instead, and with a group key, that of the first message of the
+// open group; nothing is queued then.
+func enqueueMessage(realIP string, subscription *Subscription, msg *Message, key string) (Delivery, queueOutcome, error) {
+	if key != "" {
+		if err := checkIdempotencyKey(key); err != nil {
+			return Delivery{}, outcomeQueued, &sendError{http.StatusBadRequest, err.Error()}
+		}
+		original, err := claimIdempotencyKey(subscription.ChatID, key)
+		if err != nil {
+			if sendErr, ok := err.(*sendError); ok {
+				return Delivery{}, outcomeQueued, sendErr
+			}
+			logger.Error("Failed to look up idempotency key", zap.Error(err))
+			return Delivery{}, outcomeQueued, &sendError{http.StatusInternalServerError, "Failed to queue message"}
+		}
+		if original != nil {
+			logger.Info("Repeated request from "+realIP, zap.String("delivery", original.UUID))
+			return *original, outcomeReplayed, nil
+		}
+	}
+	delivery, outcome, err := enqueueGroupedMessage(realIP, subscription, msg)
+	if key != "" {
+		if err != nil {
+			releaseIdempotencyKey(subscription.ChatID, key)
+		} else {
+			settleIdempotencyKey(subscription.ChatID, key, &delivery)
+		}
+	}
+	return delivery, outcome, err
+}
+
+func enqueueGroupedMessage(realIP string, subscription *Subscription, msg *Message) (Delivery, queueOutcome, error) {
+	delivery, err := prepareMessage(realIP, subscription, msg)
+	if err != nil {
+		return delivery, outcomeQueued, err
+	}
+	if msg.GroupKey != "" {
+		first, err := repeatInGroup(subscription.ChatID, msg.GroupKey, time.Now())
+		if err != nil {
+			logger.Error("Failed to look up alert group", zap.Error(err))
+			return delivery, outcomeQueued, &sendError{http.StatusInternalServerError, "Failed to queue message"}
+		}
+		if first != nil {
+			return *first, outcomeGrouped, nil
+		}
+	}
+	if err := enqueueDelivery(&delivery); err != nil {
+		logger.Error("Failed to queue message from "+realIP, zap.Error(err))
+		return delivery, outcomeQueued, &sendError{http.StatusInternalServerError, "Failed to queue message"}
+	}
+	if msg.GroupKey != "" {
+		// checkMessage made sure the window is valid.
+		window, _ := messageGroupWindow(msg)
+		if err := openGroup(msg.GroupKey, &delivery, window); err != nil {
+			logger.Error("Failed to open alert group", zap.String("delivery", delivery.UUID), zap.Error(err))
+		}
+	}
+	return delivery, outcomeQueued, nil
+}
+
+// queueMessage stores a message received by one of the send endpoints in
+// the delivery queue and answers with the delivery ID the client can use to
+// follow it up. A request repeated with the same Idempotency-Key header or
+// dedup_key, and a message repeated within the window of its group_key, are
+// answered with the original delivery.
+func queueMessage(c *gin.Context, realIP string, subscription *Subscription, msg *Message) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		key = msg.DedupKey
+	}
+	delivery, outcome, err := enqueueMessage(realIP, subscription, msg, key)
+	if err != nil {
+		c.JSON(err.(*sendError).status, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	switch outcome {
+	case outcomeReplayed:
+		c.Header("Idempotent-Replayed", "true")
+		respondQueued(c, "Message already queued", &delivery)
+		return
+	case outcomeGrouped:
+		respondQueued(c, "Message grouped with an earlier one", &delivery)
+		return
+	}
+	if delivery.Status == deliveryScheduled {
+		respondQueued(c, "Message scheduled", &delivery)
+		return
+	}
+	respondQueued(c, "Message queued", &delivery)
+}
+
+// resolveThread checks where in the chat a send request asks its message to
+// go and returns the forum topic: the requested one, or the default topic of
+// the token or subscription.
+func resolveThread(subscription *Subscription, threadID int, replyToMessageID int) (int, error) {
+	if threadID < 0 || replyToMessageID < 0 {
+		return 0, fmt.Errorf("thread_id and reply_to_message_id must be positive")
+	}
+	if threadID == 0 {
+		if subscription.tokenThreadID != 0 {
+			return subscription.tokenThreadID, nil
+		}
+		return subscription.ThreadID, nil
 	}
+	return threadID, nil
+}
+
+// formPlacement reads the thread_id and reply_to_message_id form fields of
+// the file and album endpoints.
+func formPlacement(c *gin.Context, subscription *Subscription) (int, int, error) {
+	var values [2]int
+	for i, name := range []string{"thread_id", "reply_to_message_id"} {
+		if value := c.PostForm(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return 0, 0, fmt.Errorf("%s must be a number", name)
+			}
+			values[i] = n
+		}
+	}
+	threadID, err := resolveThread(subscription, values[0], values[1])
+	return threadID, values[1], err
+}
+
+// applyFormOptions sets the silent, protect_content, disable_web_page_preview
+// and priority options of a delivery from the form fields of the file and
+// album endpoints.
+func applyFormOptions(c *gin.Context, delivery *Delivery) {
+	delivery.Priority = c.PostForm("priority")
+	delivery.Silent, _ = strconv.ParseBool(c.PostForm("silent"))
+	delivery.ProtectContent, _ = strconv.ParseBool(c.PostForm("protect_content"))
+	delivery.DisablePreview, _ = strconv.ParseBool(c.PostForm("disable_web_page_preview"))
+}
+
+// respondQueued answers a send request with the ID of its delivery. With the
+// wait query parameter set, it first waits for the delivery to be sent and
+// adds its state and Telegram message ID.
+func respondQueued(c *gin.Context, message string, delivery *Delivery) {
+	response := gin.H{
+		"message":     message,
+		"delivery_id": delivery.UUID,
+	}
+	if delivery.Status == deliveryScheduled {
+		response["status"] = delivery.Status
+		response["send_at"] = delivery.SendAt
+	}
+	if wait, _ := strconv.ParseBool(c.Query("wait")); wait {
+		waited := waitForDelivery(delivery.ID, deliveryWaitTimeout)
+		response["status"] = waited.Status
+		if waited.TelegramMessageID != 0 {
+			response["message_id"] = waited.TelegramMessageID
+		}
+		if waited.LastError != "" {
+			response["error"] = waited.LastError
+		}
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 func handleJSON(c *gin.Context) {
 	realIP := getRealIP(c)
 	logger.Debug("Received JSON message from " + realIP)
-	authorized, subscription := checkAuthorization(c)
-	if authorized {
+	subscription, err := checkAuthorization(c)
+	if err == nil {
 		var msg Message
-		if err := c.BindJSON(&msg); err != nil {
+		if err := c.ShouldBindJSON(&msg); err != nil {
 			logger.Error("Invalid JSON from "+realIP, zap.Error(err))
 			c.JSON(http.StatusBadRequest, gin.H{
 				"message": "Invalid JSON",
 			})
 			return
-		} else {
-			if msg.Encrypted {
-				decrypted, err := decrypt(msg.Msg, subscription.AESKey)
-				if err != nil {
-					logger.Error("Failed to decrypt message", zap.Error(err))
-					c.JSON(http.StatusBadRequest, gin.H{
-						"message": "Failed to decrypt message",
-					})
-					return
-				}
-				sendWithFormat(subscription.ChatID, decrypted, msg.Format)
-				c.JSON(http.StatusOK, gin.H{
-					"message": "Message sent",
-				})
-			} else {
-				logger.Info("Received message: " + msg.Msg)
-				// bot.Send(tgbotapi.NewMessage(subscription.ChatID, msg.Msg))
-				sendWithFormat(subscription.ChatID, msg.Msg, msg.Format)
-				c.JSON(http.StatusOK, gin.H{
-					"message": "Message sent",
-				})
-			}
 		}
+		queueMessage(c, realIP, subscription, &msg)
 	} else {
-		logger.Error("Invalid UUID or not subscribed from "+realIP, zap.Error(fmt.Errorf("invalid UUID or not subscribed")))
-		c.JSON(http.StatusNotFound, gin.H{
-			"message": "Invalid UUID or not subscribed",
-		})
+		respondAuthorizationError(c, realIP, err)
 	}
 }
 
 func handleGet(c *gin.Context) {
 	realIP := getRealIP(c)
 	logger.Debug("Received GET message from " + realIP)
-	authorized, subscription := checkAuthorization(c)
-	if authorized {
-		msg := c.Query("msg")
-		encrypted := c.Query("encrypted")
-		format := c.Query("format")
-		if format == "" {
-			format = "markdown"
-		}
-		if msg != "" {
-			if encrypted == "true" {
-				decrypted, err := decrypt(msg, subscription.AESKey)
-				if err != nil {
-					logger.Error("Failed to decrypt message from: "+realIP, zap.Error(err))
-					c.JSON(http.StatusBadRequest, gin.H{
-						"message": "Failed to decrypt message",
-					})
-					return
-				}
-				// bot.Send(tgbotapi.NewMessage(subscription.ChatID, decrypted))
-				sendWithFormat(subscription.ChatID, decrypted, format)
-				c.JSON(http.StatusOK, gin.H{
-					"message": "Message sent",
-				})
-			} else {
-				// bot.Send(tgbotapi.NewMessage(subscription.ChatID, msg))
-				sendWithFormat(subscription.ChatID, msg, format)
-				c.JSON(http.StatusOK, gin.H{
-					"message": "Message sent",
-				})
-			}
-		} else {
-			logger.Error("Invalid message from: "+realIP, zap.Error(fmt.Errorf("invalid message")))
+	subscription, err := checkAuthorization(c)
+	if err == nil {
+		var msg Message
+		if err := c.ShouldBindQuery(&msg); err != nil {
+			logger.Error("Invalid query from "+realIP, zap.Error(err))
 			c.JSON(http.StatusBadRequest, gin.H{
 				"message": "Invalid message",
 			})
+			return
+		}
+		if msg.Format == "" {
+			msg.Format = "markdown"
 		}
+		queueMessage(c, realIP, subscription, &msg)
 	} else {
-		logger.Error("Invalid UUID or not subscribed from: "+realIP, zap.Error(fmt.Errorf("invalid UUID or not subscribed")))
-		c.JSON(http.StatusNotFound, gin.H{
-			"message": "Invalid UUID or not subscribed",
-		})
+		respondAuthorizationError(c, realIP, err)
 	}
 }
 
 func handleForm(c *gin.Context) {
 	realIP := getRealIP(c)
 	logger.Debug("Received form message from " + realIP)
-	authorized, subscription := checkAuthorization(c)
-	if authorized {
-		msg := c.PostForm("msg")
-		encrypted := c.PostForm("encrypted")
-		format := c.PostForm("format")
-		if format == "" {
-			format = "markdown"
-		}
-		if msg != "" {
-			if encrypted == "true" {
-				decrypted, err := decrypt(msg, subscription.AESKey)
-				if err != nil {
-					logger.Error("Failed to decrypt message from: "+realIP, zap.Error(err))
-					c.JSON(http.StatusBadRequest, gin.H{
-						"message": "Failed to decrypt message",
-					})
-					return
-				}
-				// bot.Send(tgbotapi.NewMessage(subscription.ChatID, decrypted))
-				sendWithFormat(subscription.ChatID, decrypted, format)
-				c.JSON(http.StatusOK, gin.H{
-					"message": "Message sent",
-				})
-			} else {
-				// bot.Send(tgbotapi.NewMessage(subscription.ChatID, msg))
-				sendWithFormat(subscription.ChatID, msg, format)
-				c.JSON(http.StatusOK, gin.H{
-					"message": "Message sent",
-				})
-			}
-		} else {
-			logger.Error("Invalid message from "+realIP, zap.Error(fmt.Errorf("invalid message")))
+	subscription, err := checkAuthorization(c)
+	if err == nil {
+		var msg Message
+		if err := c.ShouldBind(&msg); err != nil {
+			logger.Error("Invalid form from "+realIP, zap.Error(err))
 			c.JSON(http.StatusBadRequest, gin.H{
 				"message": "Invalid message",
 			})
+			return
+		}
+		if msg.Format == "" {
+			msg.Format = "markdown"
 		}
+		queueMessage(c, realIP, subscription, &msg)
 	} else {
-		logger.Error("Invalid UUID or not subscribed from "+realIP, zap.Error(fmt.Errorf("invalid UUID or not subscribed")))
-		c.JSON(http.StatusNotFound, gin.H{
-			"message": "Invalid UUID or not subscribed",
-		})
+		respondAuthorizationError(c, realIP, err)
 	}
 }
 
+// fileSource is where a send request takes a file from: an upload, a URL
+// the server fetches or a path on the server.
+type fileSource struct {
+	upload *multipart.FileHeader
+	url    string
+	path   string
+}
+
+// spool stores the file in the spool, decrypting an upload with key if it
+// was sent encrypted, and returns the spool path and the file name.
+func (source fileSource) spool(c *gin.Context, encrypted bool, key string, cipherName string) (string, string, error) {
+	if source.url != "" {
+		return fetchToSpool(source.url)
+	}
+	if source.path != "" {
+		return spoolLocalFile(source.path)
+	}
+	spoolPath := newSpoolPath()
+	if encrypted {
+		if err := spoolEncryptedFile(source.upload, spoolPath, key, cipherName); err != nil {
+			return "", "", &fetchError{http.StatusBadRequest, "Failed to decrypt file"}
+		}
+	} else if err := c.SaveUploadedFile(source.upload, spoolPath); err != nil {
+		logger.Error("Failed to spool file: "+source.upload.Filename, zap.Error(err))
+		return "", "", &fetchError{http.StatusInternalServerError, "Failed to store file"}
+	}
+	return spoolPath, source.upload.Filename, nil
+}
+
 func handleFile(c *gin.Context) {
 	realIP := getRealIP(c)
 	logger.Debug("Received file from " + realIP)
-	authorized, subscription := checkAuthorization(c)
-	if authorized {
-		file, err := c.FormFile("file")
+	subscription, err := checkAuthorization(c)
+	if err == nil {
+		file, _ := c.FormFile("file")
+		source := fileSource{upload: file, url: c.PostForm("url"), path: c.PostForm("path")}
 		file_caption := c.PostForm("caption")
+		given := 0
+		for _, ok := range []bool{file != nil, source.url != "", source.path != ""} {
+			if ok {
+				given++
+			}
+		}
+		if given != 1 {
+			logger.Error("Failed to get file from "+realIP, zap.Error(fmt.Errorf("%d file sources", given)))
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Invalid file, send one of file, url or path",
+			})
+			return
+		}
+		encrypted := c.PostForm("encrypted") == "true"
+		cipherName := c.PostForm("cipher")
+		if !isValidCipher(cipherName) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Invalid cipher, must be cbc or gcm",
+			})
+			return
+		}
+		threadID, replyToMessageID, err := formPlacement(c, subscription)
 		if err != nil {
-			logger.Error("Failed to get file: "+file.Filename, zap.Error(err))
 			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "Invalid file",
+				"message": "Invalid placement: " + err.Error(),
 			})
 			return
 		}
-		if file != nil {
-			sendFile(subscription.ChatID, file, file_caption)
-			c.JSON(http.StatusOK, gin.H{
-				"message": "File sent",
+		if !isValidPriority(c.PostForm("priority")) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Invalid priority, must be normal or high",
 			})
-		} else {
+			return
+		}
+		mediaType := c.PostForm("type")
+		if mediaType == "" {
+			mediaType = mediaAuto
+		}
+		if !isValidMediaType(mediaType) {
 			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "Invalid file",
+				"message": "Invalid type, must be auto, document, photo, video, audio, voice or animation",
+			})
+			return
+		}
+		file_name := ""
+		if file != nil {
+			file_name = file.Filename
+		}
+		// The multipart filename is cut at the last slash, which base64 may
+		// contain, so the encrypted name can also be sent as a field. Files
+		// taken from a URL or path can be renamed with it.
+		if name := c.PostForm("filename"); name != "" && (encrypted || file == nil) {
+			file_name = name
+		}
+		key := subscription.AESKey
+		if encrypted {
+			decrypted := false
+			for _, field := range []struct {
+				value *string
+				name  string
+			}{{&source.url, "URL"}, {&source.path, "path"}, {&file_name, "file name"}, {&file_caption, "caption"}} {
+				if *field.value == "" {
+					continue
+				}
+				if !decrypted {
+					*field.value, key, err = decryptForSubscription(subscription, *field.value, cipherName)
+					decrypted = true
+				} else {
+					*field.value, err = decryptMessage(*field.value, key, cipherName)
+				}
+				if err != nil {
+					logger.Error("Failed to decrypt "+field.name+" from "+realIP, zap.Error(err))
+					c.JSON(http.StatusBadRequest, gin.H{
+						"message": "Failed to decrypt " + field.name,
+					})
+					return
+				}
+			}
+		}
+		spoolPath, sourceName, err := source.spool(c, encrypted, key, cipherName)
+		if err != nil {
+			respondFetchError(c, realIP, err)
+			return
+		}
+		if file_name == "" {
+			file_name = sourceName
+		}
+		logger.Debug("Received file: " + file_name)
+		delivery := Delivery{ChatID: subscription.ChatID, Kind: deliveryKindFile, FileName: file_name, MediaType: mediaType, FilePath: spoolPath, Text: withGraceWarning(subscription, file_caption), CorrelationKey: c.PostForm("correlation_key"), ThreadID: threadID, ReplyToMessageID: replyToMessageID}
+		applyFormOptions(c, &delivery)
+		if err := enqueueDelivery(&delivery); err != nil {
+			removeSpoolFile(spoolPath)
+			logger.Error("Failed to queue file from "+realIP, zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "Failed to queue file",
 			})
+			return
 		}
+		respondQueued(c, "File queued", &delivery)
 	} else {
+		respondAuthorizationError(c, realIP, err)
+	}
+}
+
+// handleAlbum queues up to ten files, with a caption each, to be sent as a
+// single media group. The files are the uploaded ones first, then those
+// named by url and then by path fields.
+func handleAlbum(c *gin.Context) {
+	realIP := getRealIP(c)
+	logger.Debug("Received album from " + realIP)
+	subscription, err := checkAuthorization(c)
+	if err != nil {
+		respondAuthorizationError(c, realIP, err)
+		return
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		logger.Error("Invalid album form from "+realIP, zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid form",
+		})
+		return
+	}
+	var sources []fileSource
+	for _, file := range form.File["file"] {
+		sources = append(sources, fileSource{upload: file})
+	}
+	for _, fileURL := range form.Value["url"] {
+		sources = append(sources, fileSource{url: fileURL})
+	}
+	for _, localPath := range form.Value["path"] {
+		sources = append(sources, fileSource{path: localPath})
+	}
+	if len(sources) < albumMinItems || len(sources) > albumMaxItems {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": fmt.Sprintf("An album needs %d to %d files, got %d", albumMinItems, albumMaxItems, len(sources)),
+		})
+		return
+	}
+	threadID, replyToMessageID, err := formPlacement(c, subscription)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid placement: " + err.Error(),
+		})
+		return
+	}
+	if !isValidPriority(c.PostForm("priority")) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid priority, must be normal or high",
+		})
+		return
+	}
+	captions := form.Value["caption"]
+	if len(captions) > len(sources) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "More captions than files",
+		})
+		return
+	}
+	requested, err := albumRequestedTypes(form.Value["type"], len(sources))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": capitalize(err.Error()),
+		})
+		return
+	}
+	encrypted := c.PostForm("encrypted") == "true"
+	cipherName := c.PostForm("cipher")
+	if !isValidCipher(cipherName) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid cipher, must be cbc or gcm",
+		})
+		return
+	}
+	names := form.Value["filename"]
+	key := subscription.AESKey
+	decrypted := false
+	items := make([]AlbumItem, len(sources))
+	for i := range sources {
+		source := &sources[i]
+		items[i] = AlbumItem{Position: i}
+		if source.upload != nil {
+			items[i].FileName = source.upload.Filename
+		}
+		if i < len(captions) {
+			items[i].Caption = captions[i]
+		}
+		if i < len(names) && names[i] != "" && (encrypted || source.upload == nil) {
+			items[i].FileName = names[i]
+		}
+		if !encrypted {
+			continue
+		}
+		for _, field := range []struct {
+			value *string
+			name  string
+		}{{&source.url, "URL"}, {&source.path, "path"}, {&items[i].FileName, "name"}, {&items[i].Caption, "caption"}} {
+			if *field.value == "" {
+				continue
+			}
+			if !decrypted {
+				*field.value, key, err = decryptForSubscription(subscription, *field.value, cipherName)
+				decrypted = true
+			} else {
+				*field.value, err = decryptMessage(*field.value, key, cipherName)
+			}
+			if err != nil {
+				logger.Error("Failed to decrypt "+field.name+" from "+realIP, zap.Error(err))
+				c.JSON(http.StatusBadRequest, gin.H{
+					"message": fmt.Sprintf("Failed to decrypt %s of file %d", field.name, i+1),
+				})
+				return
+			}
+		}
+	}
+	items[0].Caption = withGraceWarning(subscription, items[0].Caption)
+	itemCaptions := make([]string, len(items))
+	for i, item := range items {
+		itemCaptions[i] = item.Caption
+	}
+	if err := albumCaptionError(itemCaptions); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": capitalize(err.Error()),
+		})
+		return
+	}
+
+	queued := false
+	defer func() {
+		if !queued {
+			for _, item := range items {
+				removeSpoolFile(item.FilePath)
+			}
+		}
+	}()
+	detected := make([]string, len(sources))
+	for i, source := range sources {
+		spoolPath, sourceName, err := source.spool(c, encrypted, key, cipherName)
+		if err != nil {
+			respondFetchError(c, realIP, fmt.Errorf("File %d: %w", i+1, err))
+			return
+		}
+		items[i].FilePath = spoolPath
+		if items[i].FileName == "" {
+			items[i].FileName = sourceName
+		}
+		detected[i] = detectMediaType(items[i].FileName, items[i].FilePath)
+	}
+	mediaTypes, err := resolveAlbumTypes(requested, detected)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": capitalize(err.Error()),
+		})
+		return
+	}
+	for i := range items {
+		items[i].MediaType = mediaTypes[i]
+	}
+	delivery := Delivery{ChatID: subscription.ChatID, Kind: deliveryKindAlbum, Items: items, CorrelationKey: c.PostForm("correlation_key"), ThreadID: threadID, ReplyToMessageID: replyToMessageID}
+	applyFormOptions(c, &delivery)
+	if err := enqueueDelivery(&delivery); err != nil {
+		logger.Error("Failed to queue album from "+realIP, zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Failed to queue album",
+		})
+		return
+	}
+	queued = true
+	respondQueued(c, "Album queued", &delivery)
+}
+
+func handleMessageStatus(c *gin.Context) {
+	realIP := getRealIP(c)
+	subscription, err := checkAuthorization(c)
+	if err != nil {
+		respondAuthorizationError(c, realIP, err)
+		return
+	}
+	var delivery Delivery
+	if err := db.Where("uuid = ? AND chat_id = ?", c.Param("id"), subscription.ChatID).First(&delivery).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "Message not found",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, delivery)
+}
+
+// handleMessageEdit replaces the text of a sent message, or the caption of
+// a sent file. Format and overflow default to those of the original message.
+func handleMessageEdit(c *gin.Context) {
+	realIP := getRealIP(c)
+	subscription, err := checkAuthorization(c)
+	if err != nil {
+		respondAuthorizationError(c, realIP, err)
+		return
+	}
+	var delivery Delivery
+	if err := db.Where("uuid = ? AND chat_id = ?", c.Param("id"), subscription.ChatID).First(&delivery).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
-			"message": "Invalid UUID or not subscribed",
+			"message": "Message not found",
+		})
+		return
+	}
+	var msg Message
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		logger.Error("Invalid JSON from "+realIP, zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid JSON",
+		})
+		return
+	}
+	if msg.Msg == "" && delivery.Kind != deliveryKindFile {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid message",
+		})
+		return
+	}
+	if msg.Format == "" {
+		msg.Format = delivery.Format
+	}
+	if msg.Overflow == "" {
+		msg.Overflow = delivery.Overflow
+	}
+	if !isValidOverflow(msg.Overflow) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid overflow, must be split, server-html or truncate",
+		})
+		return
+	}
+	if !isValidCipher(msg.Cipher) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid cipher, must be cbc or gcm",
 		})
+		return
 	}
+	text := msg.Msg
+	if msg.Encrypted {
+		decrypted, _, err := decryptForSubscription(subscription, msg.Msg, msg.Cipher)
+		if err != nil {
+			logger.Error("Failed to decrypt message from "+realIP, zap.Error(err))
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Failed to decrypt message",
+			})
+			return
+		}
+		text = decrypted
+	}
+	if err := editDelivery(&delivery, withGraceWarning(subscription, text), msg.Format, msg.Overflow); err != nil {
+		respondEditError(c, realIP, err)
+		return
+	}
+	c.JSON(http.StatusOK, delivery)
+}
+
+// handleMessageDelete deletes a sent message from the chat, or drops it
+// from the queue if it was not sent yet.
+func handleMessageDelete(c *gin.Context) {
+	realIP := getRealIP(c)
+	subscription, err := checkAuthorization(c)
+	if err != nil {
+		respondAuthorizationError(c, realIP, err)
+		return
+	}
+	var delivery Delivery
+	if err := db.Where("uuid = ? AND chat_id = ?", c.Param("id"), subscription.ChatID).First(&delivery).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "Message not found",
+		})
+		return
+	}
+	if err := deleteDelivery(&delivery); err != nil {
+		respondEditError(c, realIP, err)
+		return
+	}
+	c.JSON(http.StatusOK, delivery)
+}
+
+func handleMessageList(c *gin.Context) {
+	realIP := getRealIP(c)
+	subscription, err := checkAuthorization(c)
+	if err != nil {
+		respondAuthorizationError(c, realIP, err)
+		return
+	}
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid page",
+		})
+		return
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	if err != nil || pageSize < 1 || pageSize > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid page_size, must be between 1 and 100",
+		})
+		return
+	}
+	query := db.Model(&Delivery{}).Where("chat_id = ?", subscription.ChatID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		logger.Error("Failed to count deliveries", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Failed to load messages",
+		})
+		return
+	}
+	deliveries := []Delivery{}
+	if err := query.Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&deliveries).Error; err != nil {
+		logger.Error("Failed to list deliveries", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Failed to load messages",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"messages":  deliveries,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
 }
 
 func handleHTML(c *gin.Context) {
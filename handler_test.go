@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestMessageStatusOfOtherChat(t *testing.T) {
+	openTestDB(t)
+	db.Create(&Subscription{ChatID: 1, UUID: "u1", ReceiveMsgs: true})
+	db.Create(&Subscription{ChatID: 2, UUID: "u2", ReceiveMsgs: true})
+	own := queueTestDelivery(t, 1, "own")
+	other := queueTestDelivery(t, 2, "other")
+
+	w, _ := serveTest(handleMessageStatus, http.MethodGet, "/api/:uuid/messages/:id", "/api/u1/messages/"+own.UUID, "", nil)
+	var status Delivery
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if w.Code != http.StatusOK || status.UUID != own.UUID || status.Status != deliveryQueued {
+		t.Errorf("own delivery answered %d: %s", w.Code, w.Body)
+	}
+	if w, _ := serveTest(handleMessageStatus, http.MethodGet, "/api/:uuid/messages/:id", "/api/u1/messages/"+other.UUID, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("delivery of another chat answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestMessageListIsScopedToChat(t *testing.T) {
+	openTestDB(t)
+	db.Create(&Subscription{ChatID: 1, UUID: "u1", ReceiveMsgs: true})
+	db.Create(&Subscription{ChatID: 2, UUID: "u2", ReceiveMsgs: true})
+	first := queueTestDelivery(t, 1, "first")
+	queueTestDelivery(t, 2, "other")
+	second := queueTestDelivery(t, 1, "second")
+	db.Model(&Delivery{}).Where("id = ?", first.ID).Update("status", deliverySent)
+
+	list := func(query string) ([]Delivery, int64) {
+		w, _ := serveTest(handleMessageList, http.MethodGet, "/api/:uuid/messages", "/api/u1/messages"+query, "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("list%s answered %d: %s", query, w.Code, w.Body)
+		}
+		var page struct {
+			Messages []Delivery `json:"messages"`
+			Total    int64      `json:"total"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return page.Messages, page.Total
+	}
+	messages, total := list("")
+	if total != 2 || len(messages) != 2 || messages[0].UUID != second.UUID || messages[1].UUID != first.UUID {
+		t.Errorf("history = %d, %+v, want the two deliveries of chat 1, newest first", total, messages)
+	}
+	for _, message := range messages {
+		if message.ChatID != 1 {
+			t.Errorf("history lists a delivery of chat %d", message.ChatID)
+		}
+	}
+	if messages, total := list("?status=sent"); total != 1 || len(messages) != 1 || messages[0].UUID != first.UUID {
+		t.Errorf("sent history = %d, %+v", total, messages)
+	}
+	if messages, _ := list("?page=2&page_size=1"); len(messages) != 1 || messages[0].UUID != first.UUID {
+		t.Errorf("second page = %+v", messages)
+	}
+	if w, _ := serveTest(handleMessageList, http.MethodGet, "/api/:uuid/messages", "/api/u1/messages?page_size=101", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("page_size 101 answered %d", w.Code)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxIdempotencyKeyLength bounds the length of idempotency keys.
+const maxIdempotencyKeyLength = 255
+
+// idempotencyClaimTimeout is how long a key stays claimed by a request that
+// has not queued its message yet, e.g. because the server stopped.
+const idempotencyClaimTimeout = time.Minute
+
+var errRequestInProgress = &sendError{http.StatusConflict, "A request with this idempotency key is in progress, try again"}
+
+func checkIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLength {
+		return fmt.Errorf("Invalid idempotency key, must be at most %d characters", maxIdempotencyKeyLength)
+	}
+	return nil
+}
+
+// claimIdempotencyKey returns the delivery queued within the idempotency
+// window by an earlier request of chatID with key, or claims key for the
+// current request, which then has to settle or release it.
+func claimIdempotencyKey(chatID int64, key string) (*Delivery, error) {
+	now := time.Now()
+	if err := db.Where("created_at < ?", now.Add(-config.IdempotencyWindow)).Delete(&IdempotencyKey{}).Error; err != nil {
+		logger.Error("Failed to remove expired idempotency keys", zap.Error(err))
+	}
+	db.Where("chat_id = ? AND key = ? AND delivery_id = ? AND created_at < ?", chatID, key, "", now.Add(-idempotencyClaimTimeout)).Delete(&IdempotencyKey{})
+	claim := IdempotencyKey{ChatID: chatID, Key: key}
+	if db.Create(&claim).Error == nil {
+		return nil, nil
+	}
+	// The key is taken, by an earlier request or one still in progress.
+	var existing IdempotencyKey
+	if err := db.Where("chat_id = ? AND key = ?", chatID, key).First(&existing).Error; err != nil {
+		return nil, err
+	}
+	if existing.DeliveryID == "" {
+		return nil, errRequestInProgress
+	}
+	var delivery Delivery
+	if err := db.Where("uuid = ?", existing.DeliveryID).First(&delivery).Error; err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// settleIdempotencyKey records the delivery queued for the request that
+// claimed key.
+func settleIdempotencyKey(chatID int64, key string, delivery *Delivery) {
+	if err := db.Model(&IdempotencyKey{}).Where("chat_id = ? AND key = ?", chatID, key).Update("delivery_id", delivery.UUID).Error; err != nil {
+		logger.Error("Failed to save idempotency key", zap.String("delivery", delivery.UUID), zap.Error(err))
+	}
+}
+
+// releaseIdempotencyKey frees key after the request that claimed it failed,
+// so that it can be retried.
+func releaseIdempotencyKey(chatID int64, key string) {
+	db.Where("chat_id = ? AND key = ? AND delivery_id = ?", chatID, key, "").Delete(&IdempotencyKey{})
+}
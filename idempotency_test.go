@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	openTestDB(t)
+	config.IdempotencyWindow = time.Hour
+	db.Create(&Subscription{ChatID: 1, UUID: "u1", ReceiveMsgs: true})
+	db.Create(&Subscription{ChatID: 2, UUID: "u2", ReceiveMsgs: true})
+
+	post := func(uuid string, key string, body string) (*httptest.ResponseRecorder, string) {
+		header := http.Header{}
+		if key != "" {
+			header.Set("Idempotency-Key", key)
+		}
+		return serveTest(handleJSON, http.MethodPost, "/api/:uuid/json", "/api/"+uuid+"/json", body, header)
+	}
+
+	w, first := post("u1", "retry-1", `{"msg": "backup done"}`)
+	if w.Code != http.StatusOK || first == "" {
+		t.Fatalf("first request answered %d: %s", w.Code, w.Body)
+	}
+	w, again := post("u1", "retry-1", `{"msg": "backup done"}`)
+	if w.Code != http.StatusOK || again != first || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry answered %d with %q, want %q", w.Code, again, first)
+	}
+	if _, field := post("u1", "", `{"msg": "backup done", "dedup_key": "retry-1"}`); field != first {
+		t.Errorf("dedup_key got %q, want %q", field, first)
+	}
+	if _, other := post("u2", "retry-1", `{"msg": "backup done"}`); other == "" || other == first {
+		t.Errorf("other subscription got %q", other)
+	}
+
+	// A rejected request does not use up its key.
+	if w, _ := post("u1", "retry-2", `{"msg": ""}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid message answered %d", w.Code)
+	}
+	if w, id := post("u1", "retry-2", `{"msg": "fixed"}`); w.Code != http.StatusOK || id == "" {
+		t.Errorf("corrected request answered %d: %s", w.Code, w.Body)
+	}
+
+	var count int64
+	db.Model(&Delivery{}).Count(&count)
+	if count != 3 {
+		t.Errorf("queued %d deliveries, want 3", count)
+	}
+
+	db.Model(&IdempotencyKey{}).Where("key = ?", "retry-1").Update("created_at", time.Now().Add(-2*time.Hour))
+	if _, later := post("u1", "retry-1", `{"msg": "backup done"}`); later == "" || later == first {
+		t.Errorf("key outside the window got %q", later)
+	}
+}
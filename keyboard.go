@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+// Prefixes of the callback data of notification buttons, so that it cannot
+// be mistaken for a subscription command. Buttons of a message sent with a
+// webhook carry the ID their callback data is stored under.
+const (
+	notificationCallbackPrefix = "n:"
+	storedCallbackPrefix       = "c:"
+)
+
+// Limits Telegram puts on inline keyboards; callback data is at most 64
+// bytes including the prefix. Stored callback data only has to fit into
+// the webhook request.
+const (
+	maxKeyboardButtons        = 100
+	maxCallbackDataSize       = 64 - len(notificationCallbackPrefix)
+	maxStoredCallbackDataSize = 1024
+)
+
+// checkButtons validates the inline keyboard of a notification: every button
+// needs a text and either an http, https or tg URL or callback data. stored
+// tells whether the callback data is stored rather than sent to Telegram.
+func checkButtons(rows [][]Button, stored bool) error {
+	maxDataSize := maxCallbackDataSize
+	if stored {
+		maxDataSize = maxStoredCallbackDataSize
+	}
+	count := 0
+	for i, row := range rows {
+		if len(row) == 0 {
+			return fmt.Errorf("button row %d is empty", i+1)
+		}
+		for j, button := range row {
+			count++
+			name := fmt.Sprintf("button %d in row %d", j+1, i+1)
+			if button.Text == "" {
+				return fmt.Errorf("%s has no text", name)
+			}
+			if (button.URL == "") == (button.CallbackData == "") {
+				return fmt.Errorf("%s needs either a url or callback_data", name)
+			}
+			if button.URL != "" {
+				u, err := url.Parse(button.URL)
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "tg") {
+					return fmt.Errorf("%s has an invalid url, must be http, https or tg", name)
+				}
+			}
+			if len(button.CallbackData) > maxDataSize {
+				return fmt.Errorf("callback_data of %s is longer than %d bytes", name, maxDataSize)
+			}
+		}
+	}
+	if count > maxKeyboardButtons {
+		return fmt.Errorf("got %d buttons, at most %d are allowed", count, maxKeyboardButtons)
+	}
+	return nil
+}
+
+// inlineKeyboard turns the buttons of a notification into the keyboard
+// attached to its message, or nil if it has none.
+func inlineKeyboard(rows [][]Button) *tgbotapi.InlineKeyboardMarkup {
+	if len(rows) == 0 {
+		return nil
+	}
+	keyboard := make([][]tgbotapi.InlineKeyboardButton, len(rows))
+	for i, row := range rows {
+		for _, button := range row {
+			if button.URL != "" {
+				keyboard[i] = append(keyboard[i], tgbotapi.NewInlineKeyboardButtonURL(button.Text, button.URL))
+			} else if button.CallbackID != "" {
+				keyboard[i] = append(keyboard[i], tgbotapi.NewInlineKeyboardButtonData(button.Text, storedCallbackPrefix+button.CallbackID))
+			} else {
+				keyboard[i] = append(keyboard[i], tgbotapi.NewInlineKeyboardButtonData(button.Text, notificationCallbackPrefix+button.CallbackData))
+			}
+		}
+	}
+	markup := tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	return &markup
+}
+
+// processNotificationCallback answers a press on a callback button of a
+// notification, so that the client stops showing it as loading.
+func processNotificationCallback(query *tgbotapi.CallbackQuery, data string) {
+	logger.Info("Receive notification button press", zap.String("data", data), zap.Int64("user_id", query.From.ID))
+	if _, err := bot.Request(tgbotapi.NewCallback(query.ID, "")); err != nil {
+		logger.Error("Failed to answer callback query", zap.Error(err))
+	}
+}
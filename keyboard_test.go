@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckButtons(t *testing.T) {
+	tests := []struct {
+		name    string
+		rows    [][]Button
+		wantErr string
+	}{
+		{"none", nil, ""},
+		{"url and callback", [][]Button{{{Text: "Open dashboard", URL: "https://grafana.example.org/d/1"}}, {{Text: "Ack", CallbackData: "ack:42"}}}, ""},
+		{"empty row", [][]Button{{}}, "button row 1 is empty"},
+		{"no text", [][]Button{{{URL: "https://example.org"}}}, "button 1 in row 1 has no text"},
+		{"url and callback data", [][]Button{{{Text: "x", URL: "https://example.org", CallbackData: "x"}}}, "button 1 in row 1 needs either a url or callback_data"},
+		{"neither", [][]Button{{{Text: "x"}, {Text: "y"}}}, "button 1 in row 1 needs either a url or callback_data"},
+		{"bad scheme", [][]Button{{{Text: "x", URL: "javascript:alert(1)"}}}, "button 1 in row 1 has an invalid url"},
+		{"long callback data", [][]Button{{{Text: "x", CallbackData: strings.Repeat("a", 63)}}}, "callback_data of button 1 in row 1 is longer than 62 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkButtons(tt.rows, false)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)) {
+				t.Errorf("checkButtons() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInlineKeyboard(t *testing.T) {
+	if inlineKeyboard(nil) != nil {
+		t.Error("keyboard without buttons")
+	}
+	keyboard := inlineKeyboard([][]Button{{{Text: "Runbook", URL: "https://example.org/runbook"}, {Text: "Ack", CallbackData: "ack"}}})
+	row := keyboard.InlineKeyboard[0]
+	if len(row) != 2 || *row[0].URL != "https://example.org/runbook" || *row[1].CallbackData != notificationCallbackPrefix+"ack" {
+		t.Errorf("inlineKeyboard() = %+v", keyboard)
+	}
+	if command := deserializeKeyboardCallbackData(*row[1].CallbackData); command.Command != "" {
+		t.Errorf("notification callback data parsed as command %q", command.Command)
+	}
+}
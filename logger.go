@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -56,6 +57,10 @@ func loggerGinMiddleware() gin.HandlerFunc {
 		c.Next()
 		end := time.Now()
 		latency := end.Sub(start)
+		// The UUID authenticates unsigned requests, keep it out of the log.
+		if id := c.Param("uuid"); id != "" {
+			path = strings.Replace(path, id, ":uuid", 1)
+		}
 		if raw != "" {
 			path = path + "?" + raw
 		}
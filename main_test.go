@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger = zap.NewNop()
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// openTestDB points db at a fresh in-memory database.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	db = initSpecialDB[Subscription](":memory:")
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+}
+
+// fakeTelegram points the bot at a server that records the form of each
+// request and answers with result.
+func fakeTelegram(t *testing.T, result string) *url.Values {
+	return fakeTelegramResponse(t, `{"ok": true, "result": `+result+`}`)
+}
+
+// fakeTelegramResponse is fakeTelegram answering with a whole response,
+// e.g. an error.
+func fakeTelegramResponse(t *testing.T, response string) *url.Values {
+	form := &url.Values{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(1 << 20)
+		*form = r.Form
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	previous := bot
+	bot = &tgbotapi.BotAPI{Token: "test", Client: server.Client()}
+	bot.SetAPIEndpoint(server.URL + "/bot%s/%s")
+	t.Cleanup(func() { bot = previous })
+	return form
+}
+
+// serveTest sends a request for target with body and header to handler,
+// served at method and route, and returns the response together with the
+// delivery_id it names, if any.
+func serveTest(handler gin.HandlerFunc, method string, route string, target string, body string, header http.Header) (*httptest.ResponseRecorder, string) {
+	router := gin.New()
+	router.Handle(method, route, handler)
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var response struct {
+		DeliveryID string `json:"delivery_id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w, response.DeliveryID
+}
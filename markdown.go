@@ -3,7 +3,6 @@ package main
 import (
 	"bytes"
 	"html/template"
-	"strings"
 
 	"github.com/gomarkdown/markdown"
 	"github.com/gomarkdown/markdown/html"
@@ -16,14 +15,6 @@ var markdownRender *html.Renderer
 var markdownParser *parser.Parser
 var htmlTemplate *template.Template
 
-func escapeMarkdownV2(text string) string {
-	charactersToEscape := []string{"_", "[", "]", "(", ")", "~", ">", "#", "+", "-", "=", "|", "{", "}", ".", "!"}
-	for _, char := range charactersToEscape {
-		text = strings.ReplaceAll(text, char, "\\"+char)
-	}
-	return text
-}
-
 func initMarkdownRender() {
 	extensions := parser.CommonExtensions | parser.AutoHeadingIDs | parser.NoEmptyLineBeforeBlock | parser.MathJax | parser.FencedCode | parser.Tables | parser.Strikethrough | parser.SpaceHeadings | parser.LaxHTMLBlocks | parser.Footnotes
 	markdownParser = parser.NewWithExtensions(extensions)
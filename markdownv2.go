@@ -0,0 +1,268 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+	"go.uber.org/zap"
+)
+
+// markdownV2Extensions is the CommonMark flavour accepted for the "markdown"
+// message format. Only syntax that Telegram can display is enabled.
+const markdownV2Extensions = parser.NoIntraEmphasis | parser.FencedCode | parser.Autolink | parser.Strikethrough | parser.SpaceHeadings | parser.Tables | parser.BackslashLineBreak | parser.NoEmptyLineBeforeBlock
+
+// escapeMarkdownV2 escapes text so Telegram shows it literally in a
+// MarkdownV2 message.
+func escapeMarkdownV2(text string) string {
+	var out strings.Builder
+	for _, r := range text {
+		if strings.ContainsRune("_*[]()~`>#+-=|{}.!\\", r) {
+			out.WriteByte('\\')
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// escapeMarkdownV2Code escapes the content of inline code and pre blocks.
+func escapeMarkdownV2Code(text string) string {
+	text = strings.ReplaceAll(text, "\\", "\\\\")
+	return strings.ReplaceAll(text, "`", "\\`")
+}
+
+// escapeMarkdownV2URL escapes the target of an inline link.
+func escapeMarkdownV2URL(url string) string {
+	url = strings.ReplaceAll(url, "\\", "\\\\")
+	return strings.ReplaceAll(url, ")", "\\)")
+}
+
+// markdownToMarkdownV2 converts CommonMark to Telegram's MarkdownV2. Bold,
+// italic, strikethrough, ||spoilers||, inline code, fenced code blocks and
+// links become Telegram entities; everything else is escaped and shown as
+// text.
+func markdownToMarkdownV2(text string) (converted string) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("Failed to convert markdown", zap.Any("recover", r))
+			converted = escapeMarkdownV2(text)
+		}
+	}()
+	doc := parser.NewWithExtensions(markdownV2Extensions).Parse([]byte(text))
+	r := &markdownV2Renderer{}
+	return r.blocks(doc.GetChildren(), "\n\n")
+}
+
+type markdownV2Renderer struct {
+	// spoilers is the number of "||" marks left in the current block that
+	// have a partner to close them.
+	spoilers int
+}
+
+func (r *markdownV2Renderer) blocks(nodes []ast.Node, separator string) string {
+	var parts []string
+	for _, node := range nodes {
+		if part := r.block(node); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, separator)
+}
+
+func (r *markdownV2Renderer) block(node ast.Node) string {
+	switch n := node.(type) {
+	case *ast.Paragraph:
+		return r.inlineBlock(n)
+	case *ast.Heading:
+		return "*" + r.inlineBlock(n) + "*"
+	case *ast.BlockQuote:
+		lines := strings.Split(r.blocks(n.Children, "\n\n"), "\n")
+		for i, line := range lines {
+			lines[i] = ">" + line
+		}
+		return strings.Join(lines, "\n")
+	case *ast.List:
+		return r.list(n)
+	case *ast.CodeBlock:
+		return "```" + escapeMarkdownV2Code(string(n.Info)) + "\n" + escapeMarkdownV2Code(strings.TrimRight(string(n.Literal), "\n")) + "\n```"
+	case *ast.HorizontalRule:
+		return "――――――――"
+	case *ast.HTMLBlock:
+		return escapeMarkdownV2(strings.TrimRight(string(n.Literal), "\n"))
+	case *ast.Table:
+		return r.table(n)
+	case *ast.MathBlock:
+		return "```\n" + escapeMarkdownV2Code(strings.TrimRight(plainText(n), "\n")) + "\n```"
+	default:
+		if container := node.AsContainer(); container != nil {
+			return r.blocks(container.Children, "\n\n")
+		}
+		return r.inline(node)
+	}
+}
+
+func (r *markdownV2Renderer) list(list *ast.List) string {
+	start := list.Start
+	if start == 0 {
+		start = 1
+	}
+	var items []string
+	for i, item := range list.Children {
+		marker := "•"
+		if list.ListFlags&ast.ListTypeOrdered != 0 {
+			delimiter := "."
+			if list.Delimiter != 0 {
+				delimiter = string(list.Delimiter)
+			}
+			marker = escapeMarkdownV2(strconv.Itoa(start+i) + delimiter)
+		}
+		indent := strings.Repeat(" ", utf8.RuneCountInString(marker)+1)
+		lines := strings.Split(r.blocks(item.GetChildren(), "\n"), "\n")
+		for j, line := range lines {
+			if j == 0 {
+				lines[j] = marker + " " + line
+			} else if line != "" {
+				lines[j] = indent + line
+			}
+		}
+		items = append(items, strings.Join(lines, "\n"))
+	}
+	return strings.Join(items, "\n")
+}
+
+// table renders a table as a monospaced pre block, since Telegram has no
+// table entity.
+func (r *markdownV2Renderer) table(table *ast.Table) string {
+	var rows [][]string
+	var widths []int
+	ast.WalkFunc(table, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		if row, ok := node.(*ast.TableRow); ok {
+			var cells []string
+			for i, cell := range row.Children {
+				text := strings.TrimSpace(plainText(cell))
+				cells = append(cells, text)
+				if i >= len(widths) {
+					widths = append(widths, 0)
+				}
+				if width := utf8.RuneCountInString(text); width > widths[i] {
+					widths[i] = width
+				}
+			}
+			rows = append(rows, cells)
+			return ast.SkipChildren
+		}
+		return ast.GoToNext
+	})
+	var lines []string
+	for _, cells := range rows {
+		for i, cell := range cells {
+			cells[i] = cell + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell))
+		}
+		lines = append(lines, strings.TrimRight(strings.Join(cells, " | "), " "))
+	}
+	return "```\n" + escapeMarkdownV2Code(strings.Join(lines, "\n")) + "\n```"
+}
+
+// inlineBlock renders the inline content of a paragraph-like block. Spoiler
+// marks are only honoured in pairs; an unpaired trailing "||" stays literal.
+func (r *markdownV2Renderer) inlineBlock(node ast.Node) string {
+	r.spoilers = countSpoilerMarks(node) &^ 1
+	return strings.TrimSpace(r.inlines(node.GetChildren()))
+}
+
+func (r *markdownV2Renderer) inlines(nodes []ast.Node) string {
+	var out strings.Builder
+	for _, node := range nodes {
+		out.WriteString(r.inline(node))
+	}
+	return out.String()
+}
+
+func (r *markdownV2Renderer) inline(node ast.Node) string {
+	switch n := node.(type) {
+	case *ast.Text:
+		return r.text(string(n.Literal))
+	case *ast.Emph:
+		return "_" + r.inlines(n.Children) + "_"
+	case *ast.Strong:
+		return "*" + r.inlines(n.Children) + "*"
+	case *ast.Del:
+		return "~" + r.inlines(n.Children) + "~"
+	case *ast.Code:
+		return "`" + escapeMarkdownV2Code(string(n.Literal)) + "`"
+	case *ast.Math:
+		return "`" + escapeMarkdownV2Code(string(n.Literal)) + "`"
+	case *ast.Link:
+		label := r.inlines(n.Children)
+		if label == "" {
+			label = escapeMarkdownV2(string(n.Destination))
+		}
+		return "[" + label + "](" + escapeMarkdownV2URL(string(n.Destination)) + ")"
+	case *ast.Image:
+		label := escapeMarkdownV2(plainText(n))
+		if label == "" {
+			label = escapeMarkdownV2(string(n.Destination))
+		}
+		return "[" + label + "](" + escapeMarkdownV2URL(string(n.Destination)) + ")"
+	case *ast.Softbreak, *ast.Hardbreak:
+		return "\n"
+	case *ast.NonBlockingSpace:
+		return " "
+	case *ast.HTMLSpan:
+		return escapeMarkdownV2(string(n.Literal))
+	default:
+		if container := node.AsContainer(); container != nil {
+			return r.inlines(container.Children)
+		}
+		return escapeMarkdownV2(string(node.AsLeaf().Literal))
+	}
+}
+
+func (r *markdownV2Renderer) text(literal string) string {
+	var out strings.Builder
+	for r.spoilers > 0 {
+		i := strings.Index(literal, "||")
+		if i < 0 {
+			break
+		}
+		out.WriteString(escapeMarkdownV2(literal[:i]))
+		out.WriteString("||")
+		r.spoilers--
+		literal = literal[i+2:]
+	}
+	out.WriteString(escapeMarkdownV2(literal))
+	return out.String()
+}
+
+func countSpoilerMarks(node ast.Node) int {
+	count := 0
+	ast.WalkFunc(node, func(node ast.Node, entering bool) ast.WalkStatus {
+		if text, ok := node.(*ast.Text); ok && entering {
+			count += strings.Count(string(text.Literal), "||")
+		}
+		return ast.GoToNext
+	})
+	return count
+}
+
+// plainText returns the text of node and its children without any markup.
+func plainText(node ast.Node) string {
+	var out strings.Builder
+	ast.WalkFunc(node, func(node ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		if leaf := node.AsLeaf(); leaf != nil {
+			out.Write(leaf.Literal)
+		} else if node.AsContainer() != nil {
+			out.Write(node.AsContainer().Literal)
+		}
+		return ast.GoToNext
+	})
+	return out.String()
+}
@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+func TestEscapeMarkdownV2(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hello world", "hello world"},
+		{"punctuation", "v1.2-beta!", "v1\\.2\\-beta\\!"},
+		{"markup characters", "*_~`|", "\\*\\_\\~\\`\\|"},
+		{"brackets", "[a](b){c}", "\\[a\\]\\(b\\)\\{c\\}"},
+		{"backslash", `C:\tmp`, `C:\\tmp`},
+		{"others", "> # + = ", "\\> \\# \\+ \\= "},
+		{"unicode", "héllo ✓", "héllo ✓"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := escapeMarkdownV2(tt.in); got != tt.want {
+				t.Errorf("escapeMarkdownV2(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkdownToMarkdownV2(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain text", "Hello world", "Hello world"},
+		{"escapes literal text", "Build #42 finished (100%).", "Build \\#42 finished \\(100%\\)\\."},
+		{"bold", "**bold**", "*bold*"},
+		{"bold underscores", "__bold__", "*bold*"},
+		{"italic", "*italic*", "_italic_"},
+		{"italic underscores", "_italic_", "_italic_"},
+		{"nested", "**bold _italic_**", "*bold _italic_*"},
+		{"strikethrough", "~~gone~~", "~gone~"},
+		{"spoiler", "the answer is ||42||", "the answer is ||42||"},
+		{"spoiler around markup", "||**secret**||", "||*secret*||"},
+		{"unpaired spoiler", "a || b", "a \\|\\| b"},
+		{"odd spoiler marks", "||x|| and ||", "||x|| and \\|\\|"},
+		{"lone asterisk", "2 * 3 = 6", "2 \\* 3 \\= 6"},
+		{"intraword underscore", "snake_case_name", "snake\\_case\\_name"},
+		{"inline code", "run `make test`", "run `make test`"},
+		{"inline code escapes", "`a\\b` and `` c`d ``", "`a\\\\b` and `c\\`d`"},
+		{"inline code keeps specials", "`x.y_z*`", "`x.y_z*`"},
+		{"code block with language", "```go\nfmt.Println(\"hi\")\n```", "```go\nfmt.Println(\"hi\")\n```"},
+		{"code block escapes", "```\na `b` \\c\n```", "```\na \\`b\\` \\\\c\n```"},
+		{"indented code block", "    x := 1", "```\nx := 1\n```"},
+		{"link", "[docs](https://example.com/a_b)", "[docs](https://example.com/a_b)"},
+		{"link label escaped", "[v1.0](https://example.com)", "[v1\\.0](https://example.com)"},
+		{"link with parenthesis", "[wiki](<https://en.wikipedia.org/wiki/Go_(language)>)", "[wiki](https://en.wikipedia.org/wiki/Go_(language\\))"},
+		{"bold link", "[**Open**](https://example.com)", "[*Open*](https://example.com)"},
+		{"autolink", "see https://example.com", "see [https://example\\.com](https://example.com)"},
+		{"image", "![chart](https://example.com/c.png)", "[chart](https://example.com/c.png)"},
+		{"heading", "# Deploy done", "*Deploy done*"},
+		{"paragraphs", "first\n\nsecond", "first\n\nsecond"},
+		{"line breaks", "line one\nline two", "line one\nline two"},
+		{"unordered list", "- one\n- two", "• one\n• two"},
+		{"ordered list", "1. one\n2. two", "1\\. one\n2\\. two"},
+		{"nested list", "- one\n  - inner\n- two", "• one\n  • inner\n• two"},
+		{"blockquote", "> quoted\n> text", ">quoted\n>text"},
+		{"horizontal rule", "a\n\n---\n\nb", "a\n\n――――――――\n\nb"},
+		{"table", "| a | bb |\n|---|----|\n| 1 | 2 |", "```\na | bb\n1 | 2\n```"},
+		{"html is literal", "<b>x</b>", "<b\\>x</b\\>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := markdownToMarkdownV2(tt.in); got != tt.want {
+				t.Errorf("markdownToMarkdownV2(%q)\n got: %q\nwant: %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Telegram media types a file can be sent as. mediaAuto picks one from the
+// MIME type of the file.
+const (
+	mediaAuto      = "auto"
+	mediaDocument  = "document"
+	mediaPhoto     = "photo"
+	mediaVideo     = "video"
+	mediaAudio     = "audio"
+	mediaVoice     = "voice"
+	mediaAnimation = "animation"
+)
+
+// telegramCaptionLimit is the maximum length of a media caption, counted in
+// UTF-16 code units.
+const telegramCaptionLimit = 1024
+
+// telegramPhotoLimit is the largest file Telegram accepts as a photo.
+const telegramPhotoLimit = 10 << 20
+
+func isValidMediaType(mediaType string) bool {
+	switch mediaType {
+	case "", mediaAuto, mediaDocument, mediaPhoto, mediaVideo, mediaAudio, mediaVoice, mediaAnimation:
+		return true
+	}
+	return false
+}
+
+// mediaTypeForMIME maps a MIME type to the media type Telegram shows inline.
+// Anything Telegram would not preview is sent as a document.
+func mediaTypeForMIME(mimeType string) string {
+	if parsed, _, err := mime.ParseMediaType(mimeType); err == nil {
+		mimeType = parsed
+	}
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/webp":
+		return mediaPhoto
+	case "image/gif":
+		return mediaAnimation
+	case "video/mp4":
+		return mediaVideo
+	case "audio/mpeg", "audio/mp3", "audio/mp4", "audio/x-m4a", "audio/m4a", "audio/flac", "audio/x-flac":
+		return mediaAudio
+	case "audio/ogg", "audio/opus":
+		return mediaVoice
+	}
+	return mediaDocument
+}
+
+// detectMediaType picks the media type of a spooled file from the MIME type
+// of its name, or of its content if the name has no known extension.
+func detectMediaType(name string, path string) string {
+	mimeType := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	file, err := os.Open(path)
+	if err != nil {
+		return mediaDocument
+	}
+	defer file.Close()
+	if mimeType == "" {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(file, head)
+		mimeType = http.DetectContentType(head[:n])
+	}
+	mediaType := mediaTypeForMIME(mimeType)
+	if info, err := file.Stat(); err == nil && mediaType == mediaPhoto && info.Size() > telegramPhotoLimit {
+		return mediaDocument
+	}
+	return mediaType
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMediaTypeForMIME(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"image/png", mediaPhoto},
+		{"image/jpeg", mediaPhoto},
+		{"image/gif", mediaAnimation},
+		{"image/svg+xml", mediaDocument},
+		{"video/mp4", mediaVideo},
+		{"video/x-matroska", mediaDocument},
+		{"audio/mpeg", mediaAudio},
+		{"audio/ogg", mediaVoice},
+		{"text/plain; charset=utf-8", mediaDocument},
+		{"application/pdf", mediaDocument},
+		{"", mediaDocument},
+	}
+	for _, tt := range tests {
+		if got := mediaTypeForMIME(tt.in); got != tt.want {
+			t.Errorf("mediaTypeForMIME(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDetectMediaType(t *testing.T) {
+	dir := t.TempDir()
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 64)...)
+	path := filepath.Join(dir, "spooled")
+	if err := os.WriteFile(path, png, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	large := filepath.Join(dir, "large")
+	if err := os.WriteFile(large, append(png, make([]byte, telegramPhotoLimit)...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"screenshot.png", path, mediaPhoto},
+		{"report.pdf", path, mediaDocument},
+		{"screenshot", path, mediaPhoto},
+		{"huge.png", large, mediaDocument},
+		{"missing.png", filepath.Join(dir, "missing"), mediaDocument},
+	}
+	for _, tt := range tests {
+		if got := detectMediaType(tt.name, tt.path); got != tt.want {
+			t.Errorf("detectMediaType(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	deliveryQueued  = "queued"
+	deliverySending = "sending"
+	deliverySent    = "sent"
+	deliveryFailed  = "failed"
+	deliveryDeleted = "deleted"
+	// Held deliveries wait for the quiet hours of their chat to end, and
+	// digested ones were sent as part of a digest.
+	deliveryHeld     = "held"
+	deliveryDigested = "digested"
+	// Scheduled deliveries wait for their SendAt time.
+	deliveryScheduled = "scheduled"
+)
+
+const (
+	deliveryKindText  = "text"
+	deliveryKindFile  = "file"
+	deliveryKindAlbum = "album"
+)
+
+var spoolDir string
+
+// deliveryQueue hands queued deliveries to a pool of workers. Deliveries for
+// the same chat are sent one at a time and in the order they were queued.
+type deliveryQueue struct {
+	mu   sync.Mutex
+	busy map[int64]bool
+	jobs chan Delivery
+	wake chan struct{}
+}
+
+var queue = &deliveryQueue{
+	busy: make(map[int64]bool),
+	jobs: make(chan Delivery),
+	wake: make(chan struct{}, 1),
+}
+
+func initSpool(path string) {
+	if path == "" {
+		path = filepath.Join(filepath.Dir(*db_path), "spool")
+	}
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		logger.Fatal("Failed to create spool directory: "+path, zap.Error(err))
+		panic(err)
+	}
+	spoolDir = path
+	logger.Info("Spool directory " + spoolDir + " initialized")
+}
+
+// newSpoolPath returns a fresh path inside the spool directory for a file
+// that has to outlive the request which uploaded it.
+func newSpoolPath() string {
+	return filepath.Join(spoolDir, uuid.New().String())
+}
+
+// spoolEncryptedFile decrypts an uploaded file into the spool at path. The
+// partial file is removed again if decryption fails.
+func spoolEncryptedFile(file *multipart.FileHeader, path string, key string, cipherName string) error {
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = decryptFile(dst, src, key, cipherName)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeSpoolFile(path)
+	}
+	return err
+}
+
+func removeSpoolFile(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logger.Error("Failed to remove spool file: "+path, zap.Error(err))
+	}
+}
+
+// removeDeliveryFiles removes the spooled files of a delivery that no longer
+// needs them.
+func removeDeliveryFiles(delivery *Delivery) {
+	removeSpoolFile(delivery.FilePath)
+	if delivery.Kind != deliveryKindAlbum {
+		return
+	}
+	var items []AlbumItem
+	db.Where("delivery_id = ?", delivery.ID).Find(&items)
+	for _, item := range items {
+		removeSpoolFile(item.FilePath)
+	}
+}
+
+// prepareDelivery gives a new delivery its ID and queues it for now, or
+// schedules it for its SendAt time.
+func prepareDelivery(delivery *Delivery) {
+	delivery.UUID = strings.Replace(uuid.New().String(), "-", "", -1)
+	delivery.Status = deliveryQueued
+	delivery.NextAttemptAt = time.Now()
+	if delivery.SendAt != nil && delivery.SendAt.After(delivery.NextAttemptAt) {
+		delivery.Status = deliveryScheduled
+		delivery.NextAttemptAt = *delivery.SendAt
+	}
+}
+
+// enqueueDelivery stores a delivery, together with its album items, and
+// wakes up the dispatcher.
+func enqueueDelivery(delivery *Delivery) error {
+	prepareDelivery(delivery)
+	if err := db.Create(delivery).Error; err != nil {
+		return err
+	}
+	logger.Debug("Queued delivery", zap.String("delivery", delivery.UUID), zap.Int64("chatID", delivery.ChatID))
+	queue.notify()
+	return nil
+}
+
+func (q *deliveryQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func startDeliveryQueue(workers int) {
+	// Deliveries still marked as sending were interrupted by a restart.
+	db.Model(&Delivery{}).Where("status = ?", deliverySending).Update("status", deliveryQueued)
+	for i := 0; i < workers; i++ {
+		go queue.work()
+	}
+	go queue.dispatch()
+	logger.Info("Delivery queue started", zap.Int("workers", workers))
+}
+
+func (q *deliveryQueue) dispatch() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		for _, delivery := range q.due() {
+			q.jobs <- delivery
+		}
+		select {
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// due claims the oldest queued delivery of every idle chat whose next
+// attempt is due.
+func (q *deliveryQueue) due() []Delivery {
+	var pending []Delivery
+	if err := db.Select("id", "chat_id", "next_attempt_at").Where("status = ?", deliveryQueued).Order("id").Find(&pending).Error; err != nil {
+		logger.Error("Failed to load queued deliveries", zap.Error(err))
+		return nil
+	}
+	now := time.Now()
+	seen := make(map[int64]bool)
+	var claimed []Delivery
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, delivery := range pending {
+		if seen[delivery.ChatID] {
+			continue
+		}
+		seen[delivery.ChatID] = true
+		if q.busy[delivery.ChatID] || delivery.NextAttemptAt.After(now) {
+			continue
+		}
+		if err := db.Model(&Delivery{}).Where("id = ?", delivery.ID).Update("status", deliverySending).Error; err != nil {
+			logger.Error("Failed to claim delivery", zap.Uint("id", delivery.ID), zap.Error(err))
+			continue
+		}
+		q.busy[delivery.ChatID] = true
+		claimed = append(claimed, delivery)
+	}
+	return claimed
+}
+
+func (q *deliveryQueue) work() {
+	for delivery := range q.jobs {
+		q.process(delivery.ID)
+		q.mu.Lock()
+		delete(q.busy, delivery.ChatID)
+		q.mu.Unlock()
+		q.notify()
+	}
+}
+
+func (q *deliveryQueue) process(id uint) {
+	var delivery Delivery
+	if err := db.First(&delivery, id).Error; err != nil {
+		logger.Error("Failed to load delivery", zap.Uint("id", id), zap.Error(err))
+		return
+	}
+	if !applyQuietHours(&delivery, time.Now()) {
+		return
+	}
+	if wait := limiter.delay(delivery.ChatID); wait > 0 {
+		q.postpone(&delivery, wait, nil)
+		return
+	}
+	err := deliver(&delivery)
+	if wait := retryAfter(err); wait > 0 {
+		q.postpone(&delivery, wait, err)
+		return
+	}
+	now := time.Now()
+	delivery.Attempts++
+	if err == nil {
+		delivery.Status = deliverySent
+		delivery.LastError = ""
+		delivery.SentAt = &now
+		removeDeliveryFiles(&delivery)
+		logger.Debug("Delivered", zap.String("delivery", delivery.UUID), zap.Int("message_id", delivery.TelegramMessageID), zap.Int("parts", delivery.Parts))
+	} else {
+		delivery.LastError = err.Error()
+		if isPermanentSendError(err) || delivery.Attempts >= config.QueueMaxAttempts {
+			delivery.Status = deliveryFailed
+			removeDeliveryFiles(&delivery)
+			logger.Error("Delivery failed", zap.String("delivery", delivery.UUID), zap.Int("attempts", delivery.Attempts), zap.Error(err))
+		} else {
+			delivery.Status = deliveryQueued
+			delivery.NextAttemptAt = now.Add(retryBackoff(delivery.Attempts))
+			logger.Info("Delivery will be retried", zap.String("delivery", delivery.UUID), zap.Int("attempts", delivery.Attempts), zap.Time("next_attempt", delivery.NextAttemptAt), zap.Error(err))
+		}
+	}
+	if err := db.Save(&delivery).Error; err != nil {
+		logger.Error("Failed to save delivery", zap.String("delivery", delivery.UUID), zap.Error(err))
+	}
+}
+
+// postpone puts a delivery back into the queue without counting an attempt,
+// used when the chat is throttled by the rate limiter or by Telegram.
+func (q *deliveryQueue) postpone(delivery *Delivery, wait time.Duration, err error) {
+	delivery.Status = deliveryQueued
+	delivery.NextAttemptAt = time.Now().Add(wait)
+	if err != nil {
+		delivery.LastError = err.Error()
+	}
+	if err := db.Save(delivery).Error; err != nil {
+		logger.Error("Failed to save delivery", zap.String("delivery", delivery.UUID), zap.Error(err))
+	}
+}
+
+func deliver(delivery *Delivery) error {
+	switch delivery.Kind {
+	case deliveryKindFile:
+		sent, err := sendFile(delivery.ChatID, delivery.FilePath, delivery.FileName, delivery.MediaType, delivery.Text, deliveryOptions(delivery))
+		if err != nil {
+			return err
+		}
+		recordSentMessage(delivery, sent.MessageID)
+		return nil
+	case deliveryKindAlbum:
+		var items []AlbumItem
+		if err := db.Where("delivery_id = ?", delivery.ID).Order("position").Find(&items).Error; err != nil {
+			return err
+		}
+		sent, err := sendAlbum(delivery.ChatID, items, deliveryOptions(delivery))
+		if err != nil {
+			return err
+		}
+		for _, message := range sent {
+			recordSentMessage(delivery, message.MessageID)
+		}
+		return nil
+	default:
+		return deliverText(delivery)
+	}
+}
+
+// deliverText sends the parts of a text delivery that were not sent by an
+// earlier attempt. The keyboard goes with the last part, below all of the
+// text.
+func deliverText(delivery *Delivery) error {
+	parts, parseMode, err := renderMessage(delivery.Text, delivery.Format, delivery.Overflow, delivery.UUID)
+	if err != nil {
+		return err
+	}
+	options := deliveryOptions(delivery)
+	for part := delivery.Parts; part < len(parts); part++ {
+		var keyboard *tgbotapi.InlineKeyboardMarkup
+		if part == len(parts)-1 {
+			keyboard = inlineKeyboard(delivery.Buttons)
+		}
+		// Only the first part replies, the others follow it.
+		partOptions := options
+		if part > 0 {
+			partOptions = options.followUp()
+		}
+		sent, err := sendMessage(delivery.ChatID, parts[part], parseMode, keyboard, partOptions)
+		if err != nil {
+			return err
+		}
+		recordSentMessage(delivery, sent.MessageID)
+	}
+	return nil
+}
+
+// recordSentMessage remembers a Telegram message sent for delivery. The
+// progress is saved right away so a retry does not send the part again.
+func recordSentMessage(delivery *Delivery, messageID int) {
+	if delivery.Parts == 0 {
+		delivery.TelegramMessageID = messageID
+	}
+	if err := db.Create(&SentMessage{DeliveryID: delivery.ID, ChatID: delivery.ChatID, MessageID: messageID, Part: delivery.Parts}).Error; err != nil {
+		logger.Error("Failed to save sent message", zap.String("delivery", delivery.UUID), zap.Error(err))
+	}
+	delivery.Parts++
+	if err := db.Model(&Delivery{}).Where("id = ?", delivery.ID).Updates(map[string]interface{}{"parts": delivery.Parts, "telegram_message_id": delivery.TelegramMessageID}).Error; err != nil {
+		logger.Error("Failed to save delivery progress", zap.String("delivery", delivery.UUID), zap.Error(err))
+	}
+}
+
+func retryBackoff(attempts int) time.Duration {
+	backoff := config.QueueRetryBase
+	for i := 1; i < attempts && backoff < config.QueueRetryMax; i++ {
+		backoff *= 2
+	}
+	if backoff > config.QueueRetryMax {
+		backoff = config.QueueRetryMax
+	}
+	return backoff
+}
+
+// isPermanentSendError reports whether retrying the send cannot succeed,
+// e.g. because Telegram rejected the message or the bot was blocked.
+func isPermanentSendError(err error) bool {
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	var apiErr *tgbotapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.RetryAfter > 0 {
+		return false
+	}
+	switch apiErr.Code {
+	case 400, 403, 404:
+		return true
+	case 0:
+		// Uploads do not report the error code, only the description.
+		return strings.HasPrefix(apiErr.Message, "Bad Request") || strings.HasPrefix(apiErr.Message, "Forbidden")
+	}
+	return false
+}
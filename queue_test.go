@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// testQueueConfig sets the queue settings for a test and a fresh rate
+// limiter, so that sends of earlier tests do not hold it back.
+func testQueueConfig(t *testing.T, maxAttempts int) {
+	previous, previousLimiter := config, limiter
+	config.QueueMaxAttempts = maxAttempts
+	config.QueueRetryBase = 2 * time.Second
+	config.QueueRetryMax = time.Minute
+	limiter = newRateLimiter()
+	t.Cleanup(func() { config, limiter = previous, previousLimiter })
+}
+
+func TestRetryBackoff(t *testing.T) {
+	testQueueConfig(t, 8)
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{5, 32 * time.Second},
+		{6, time.Minute},
+		{100, time.Minute},
+	}
+	for _, test := range tests {
+		if got := retryBackoff(test.attempts); got != test.want {
+			t.Errorf("retryBackoff(%d) = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestIsPermanentSendError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("open spool file: %w", os.ErrNotExist), true},
+		{&tgbotapi.Error{Code: 400, Message: "Bad Request: chat not found"}, true},
+		{&tgbotapi.Error{Code: 403, Message: "Forbidden: bot was blocked by the user"}, true},
+		{&tgbotapi.Error{Code: 404, Message: "Not Found"}, true},
+		{&tgbotapi.Error{Code: 0, Message: "Bad Request: wrong file identifier"}, true},
+		{&tgbotapi.Error{Code: 429, Message: "Too Many Requests", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}}, false},
+		{&tgbotapi.Error{Code: 400, ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}}, false},
+		{&tgbotapi.Error{Code: 500, Message: "Internal Server Error"}, false},
+		{&tgbotapi.Error{Code: 0, Message: "Gateway Timeout"}, false},
+		{errors.New("connection reset by peer"), false},
+	}
+	for _, test := range tests {
+		if got := isPermanentSendError(test.err); got != test.want {
+			t.Errorf("isPermanentSendError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func queueTestDelivery(t *testing.T, chatID int64, text string) Delivery {
+	t.Helper()
+	delivery := Delivery{ChatID: chatID, Kind: deliveryKindText, Text: text}
+	if err := enqueueDelivery(&delivery); err != nil {
+		t.Fatal(err)
+	}
+	return delivery
+}
+
+func TestProcessSends(t *testing.T) {
+	openTestDB(t)
+	testQueueConfig(t, 3)
+	fakeTelegram(t, `{"message_id": 42, "chat": {"id": 1}}`)
+	delivery := queueTestDelivery(t, 1, "Backup done")
+	queue.process(delivery.ID)
+
+	db.First(&delivery, delivery.ID)
+	if delivery.Status != deliverySent || delivery.TelegramMessageID != 42 || delivery.Attempts != 1 || delivery.SentAt == nil {
+		t.Errorf("delivery = %+v", delivery)
+	}
+}
+
+func TestProcessRetriesUntilMaxAttempts(t *testing.T) {
+	openTestDB(t)
+	testQueueConfig(t, 2)
+	fakeTelegramResponse(t, `{"ok": false, "error_code": 500, "description": "Internal Server Error"}`)
+	delivery := queueTestDelivery(t, 1, "Backup done")
+
+	queue.process(delivery.ID)
+	db.First(&delivery, delivery.ID)
+	if delivery.Status != deliveryQueued || delivery.Attempts != 1 || delivery.LastError == "" || !delivery.NextAttemptAt.After(time.Now()) {
+		t.Fatalf("after the first attempt: %+v", delivery)
+	}
+	// The limiter would hold back the second attempt for a second.
+	limiter = newRateLimiter()
+	queue.process(delivery.ID)
+	db.First(&delivery, delivery.ID)
+	if delivery.Status != deliveryFailed || delivery.Attempts != 2 {
+		t.Errorf("after the last attempt: status %q, %d attempts", delivery.Status, delivery.Attempts)
+	}
+}
+
+func TestProcessFailsOnPermanentError(t *testing.T) {
+	openTestDB(t)
+	testQueueConfig(t, 8)
+	fakeTelegramResponse(t, `{"ok": false, "error_code": 403, "description": "Forbidden: bot was blocked by the user"}`)
+	delivery := queueTestDelivery(t, 1, "Backup done")
+	queue.process(delivery.ID)
+
+	db.First(&delivery, delivery.ID)
+	if delivery.Status != deliveryFailed || delivery.Attempts != 1 {
+		t.Errorf("status %q after %d attempts, want failed after 1", delivery.Status, delivery.Attempts)
+	}
+}
+
+func TestProcessPostpones(t *testing.T) {
+	openTestDB(t)
+	testQueueConfig(t, 8)
+	fakeTelegramResponse(t, `{"ok": false, "error_code": 429, "description": "Too Many Requests: retry after 5", "parameters": {"retry_after": 5}}`)
+	flooded := queueTestDelivery(t, 1, "Backup done")
+	queue.process(flooded.ID)
+
+	db.First(&flooded, flooded.ID)
+	if flooded.Status != deliveryQueued || flooded.Attempts != 0 || flooded.NextAttemptAt.Before(time.Now().Add(4*time.Second)) {
+		t.Errorf("flood-controlled delivery = status %q, %d attempts, next at %v", flooded.Status, flooded.Attempts, flooded.NextAttemptAt)
+	}
+	if wait := limiter.delay(1); wait < 4*time.Second {
+		t.Errorf("chat paused for %v, want about 5s", wait)
+	}
+
+	// A chat held back by the rate limiter is postponed without a request.
+	throttled := queueTestDelivery(t, 2, "Backup done")
+	limiter.wait(2)
+	queue.process(throttled.ID)
+	db.First(&throttled, throttled.ID)
+	if throttled.Status != deliveryQueued || throttled.Attempts != 0 || throttled.LastError != "" || !throttled.NextAttemptAt.After(time.Now()) {
+		t.Errorf("throttled delivery = %+v", throttled)
+	}
+}
+
+func TestDueKeepsChatOrder(t *testing.T) {
+	openTestDB(t)
+	q := &deliveryQueue{busy: make(map[int64]bool), jobs: make(chan Delivery), wake: make(chan struct{}, 1)}
+	backingOff := queueTestDelivery(t, 1, "first")
+	db.Model(&Delivery{}).Where("id = ?", backingOff.ID).Update("next_attempt_at", time.Now().Add(time.Minute))
+	queueTestDelivery(t, 1, "second")
+	other := queueTestDelivery(t, 2, "other chat")
+
+	due := q.due()
+	if len(due) != 1 || due[0].ID != other.ID {
+		t.Fatalf("due() = %+v, want only the delivery of the other chat", due)
+	}
+	// The claimed chat is busy until its delivery is processed.
+	if due := q.due(); len(due) != 0 {
+		t.Errorf("due() claimed %+v while everything is backing off or busy", due)
+	}
+
+	db.Model(&Delivery{}).Where("id = ?", backingOff.ID).Update("next_attempt_at", time.Now())
+	if due := q.due(); len(due) != 1 || due[0].ID != backingOff.ID {
+		t.Errorf("due() = %+v, want the first delivery of the chat", due)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Time zones for /quiet, also where the system has no zoneinfo.
+	_ "time/tzdata"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// What happens to notifications during quiet hours.
+const (
+	quietSilent = "silent"
+	quietDigest = "digest"
+)
+
+// priorityHigh marks notifications that are sent during quiet hours as usual.
+const priorityHigh = "high"
+
+func isValidPriority(priority string) bool {
+	return priority == "" || priority == "normal" || priority == priorityHigh
+}
+
+// quietWindow is a daily window of quiet hours in minutes since midnight.
+// A window that ends before it starts lasts over midnight.
+type quietWindow struct {
+	start int
+	end   int
+}
+
+func (w quietWindow) contains(minute int) bool {
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+func (w quietWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+}
+
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, use HH:MM", value)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// parseQuietHours parses comma-separated windows such as "23:00-07:00".
+func parseQuietHours(spec string) ([]quietWindow, error) {
+	var windows []quietWindow
+	for _, part := range strings.Split(spec, ",") {
+		from, to, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid window %q, use HH:MM-HH:MM", part)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("window %q is empty", part)
+		}
+		windows = append(windows, quietWindow{start, end})
+	}
+	return windows, nil
+}
+
+// subscriptionLocation is the time zone times are shown in to a chat: that
+// of its quiet hours, or UTC.
+func subscriptionLocation(subscription *Subscription) *time.Location {
+	location, err := time.LoadLocation(subscription.QuietTimezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// emphasize makes text bold in format.
+func emphasize(text string, format string) string {
+	switch strings.ToLower(format) {
+	case "markdown", "server-html":
+		return "**" + text + "**"
+	case "in-app-html":
+		return "<b>" + text + "</b>"
+	}
+	return text
+}
+
+// quietUntil reports whether now lies within the quiet hours of subscription
+// and, if so, when they end.
+func quietUntil(subscription *Subscription, now time.Time) (time.Time, bool) {
+	if subscription.QuietHours == "" {
+		return time.Time{}, false
+	}
+	windows, err := parseQuietHours(subscription.QuietHours)
+	if err != nil {
+		return time.Time{}, false
+	}
+	location := subscriptionLocation(subscription)
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	var until time.Time
+	for _, window := range windows {
+		if !window.contains(minute) {
+			continue
+		}
+		end := time.Date(local.Year(), local.Month(), local.Day(), window.end/60, window.end%60, 0, 0, location)
+		if !end.After(local) {
+			end = end.AddDate(0, 0, 1)
+		}
+		if end.After(until) {
+			until = end
+		}
+	}
+	return until, !until.IsZero()
+}
+
+// applyQuietHours decides what happens to a delivery that is about to be
+// sent during the quiet hours of its chat: it is sent silently, or held
+// until they end and reported false. Urgent deliveries, and the rest of a
+// message that was partly sent, go out as usual.
+func applyQuietHours(delivery *Delivery, now time.Time) bool {
+	if delivery.Priority == priorityHigh || delivery.Parts > 0 {
+		return true
+	}
+	var subscription Subscription
+	db.First(&subscription, "chat_id = ?", delivery.ChatID)
+	until, quiet := quietUntil(&subscription, now)
+	if !quiet {
+		return true
+	}
+	if subscription.QuietMode != quietDigest {
+		delivery.Silent = true
+		return true
+	}
+	delivery.Status = deliveryHeld
+	delivery.NextAttemptAt = until
+	if err := db.Save(delivery).Error; err != nil {
+		logger.Error("Failed to hold delivery", zap.String("delivery", delivery.UUID), zap.Error(err))
+	}
+	logger.Debug("Held delivery for quiet hours", zap.String("delivery", delivery.UUID), zap.Time("until", until))
+	return false
+}
+
+func startQuietHours() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			releaseHeldDeliveries(now)
+		}
+	}()
+}
+
+// releaseHeldDeliveries ends the quiet hours of the deliveries held until
+// now. Plain notifications are merged into one digest per topic and format;
+// files, albums and notifications with buttons are sent on their own.
+func releaseHeldDeliveries(now time.Time) {
+	var held []Delivery
+	if err := db.Where("status = ? AND next_attempt_at <= ?", deliveryHeld, now).Order("id").Find(&held).Error; err != nil {
+		logger.Error("Failed to load held deliveries", zap.Error(err))
+		return
+	}
+	type digestKey struct {
+		chatID   int64
+		threadID int
+		format   string
+	}
+	var keys []digestKey
+	groups := make(map[digestKey][]Delivery)
+	var single []uint
+	for _, delivery := range held {
+		if delivery.Kind != deliveryKindText || len(delivery.Buttons) > 0 {
+			single = append(single, delivery.ID)
+			continue
+		}
+		key := digestKey{delivery.ChatID, delivery.ThreadID, delivery.Format}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], delivery)
+	}
+	if len(single) > 0 {
+		if err := db.Model(&Delivery{}).Where("id IN ? AND status = ?", single, deliveryHeld).Updates(map[string]interface{}{"status": deliveryQueued, "next_attempt_at": now}).Error; err != nil {
+			logger.Error("Failed to release held deliveries", zap.Error(err))
+		}
+	}
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) == 1 {
+			db.Model(&Delivery{}).Where("id = ? AND status = ?", group[0].ID, deliveryHeld).Updates(map[string]interface{}{"status": deliveryQueued, "next_attempt_at": now})
+			continue
+		}
+		if err := queueDigest(group); err != nil {
+			logger.Error("Failed to queue digest", zap.Int64("chatID", key.chatID), zap.Error(err))
+		}
+	}
+	queue.notify()
+}
+
+// errHeldReleased rolls back a digest whose deliveries were released by a
+// concurrent run of releaseHeldDeliveries.
+var errHeldReleased = errors.New("held deliveries already released")
+
+// queueDigest queues a single notification with the texts of deliveries,
+// which all have the same chat, topic and format, and marks them digested.
+// It queues nothing if any of them is no longer held.
+func queueDigest(deliveries []Delivery) error {
+	var subscription Subscription
+	db.First(&subscription, "chat_id = ?", deliveries[0].ChatID)
+	location := subscriptionLocation(&subscription)
+	format := deliveries[0].Format
+	texts := []string{emphasize(strconv.Itoa(len(deliveries))+" notifications arrived during quiet hours", format)}
+	ids := make([]uint, len(deliveries))
+	for i, delivery := range deliveries {
+		texts = append(texts, "["+delivery.CreatedAt.In(location).Format("15:04")+"]\n"+delivery.Text)
+		ids[i] = delivery.ID
+	}
+	digest := Delivery{ChatID: deliveries[0].ChatID, Kind: deliveryKindText, Format: format, Text: strings.Join(texts, "\n\n"), ThreadID: deliveries[0].ThreadID}
+	for _, delivery := range deliveries {
+		// The digest is as protected as the most protected notification.
+		digest.ProtectContent = digest.ProtectContent || delivery.ProtectContent
+		digest.DisablePreview = digest.DisablePreview || delivery.DisablePreview
+	}
+	prepareDelivery(&digest)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&digest).Error; err != nil {
+			return err
+		}
+		result := tx.Model(&Delivery{}).Where("id IN ? AND status = ?", ids, deliveryHeld).Updates(map[string]interface{}{"status": deliveryDigested, "digest_id": digest.UUID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != int64(len(ids)) {
+			return errHeldReleased
+		}
+		return nil
+	})
+	if err == errHeldReleased {
+		return nil
+	}
+	return err
+}
+
+// handleQuiet shows or sets the quiet hours of chatID:
+// /quiet 23:00-07:00[,12:00-13:00] [time zone] [silent|digest], or /quiet off.
+func handleQuiet(chatID int64, managerID int64, args []string) {
+	var subscription Subscription
+	db.First(&subscription, "chat_id = ?", chatID)
+	if subscription.UUID == "" {
+		bot.Send(tgbotapi.NewMessage(managerID, "Invalid UUID or not subscribed"))
+		return
+	}
+	usage := "Usage: /quiet <HH:MM-HH:MM>[,<HH:MM-HH:MM>…] [time zone, e.g. Europe/Berlin] [silent|digest], or /quiet off"
+	if len(args) > 0 {
+		if strings.ToLower(args[0]) == "off" {
+			subscription.QuietHours = ""
+		} else {
+			windows, err := parseQuietHours(args[0])
+			if err != nil {
+				bot.Send(tgbotapi.NewMessage(managerID, err.Error()+"\n\n"+usage))
+				return
+			}
+			spec := make([]string, len(windows))
+			for i, window := range windows {
+				spec[i] = window.String()
+			}
+			subscription.QuietHours = strings.Join(spec, ",")
+			if subscription.QuietMode == "" {
+				subscription.QuietMode = quietSilent
+			}
+			for _, arg := range args[1:] {
+				switch strings.ToLower(arg) {
+				case quietSilent, quietDigest:
+					subscription.QuietMode = strings.ToLower(arg)
+				default:
+					if _, err := time.LoadLocation(arg); err != nil || arg == "Local" {
+						bot.Send(tgbotapi.NewMessage(managerID, "Unknown time zone "+arg+"\n\n"+usage))
+						return
+					}
+					subscription.QuietTimezone = arg
+				}
+			}
+		}
+		if err := saveSubscription(&subscription); err != nil {
+			logger.Error("Failed to save quiet hours", zap.Error(err))
+			bot.Send(tgbotapi.NewMessage(managerID, "Failed to save quiet hours"))
+			return
+		}
+		if subscription.QuietHours == "" {
+			// Whatever was held for the quiet hours goes out right away.
+			db.Model(&Delivery{}).Where("chat_id = ? AND status = ?", chatID, deliveryHeld).Update("next_attempt_at", time.Now())
+			go releaseHeldDeliveries(time.Now())
+		}
+	}
+	bot.Send(tgbotapi.NewMessage(managerID, describeQuietHours(&subscription)))
+}
+
+func describeQuietHours(subscription *Subscription) string {
+	if subscription.QuietHours == "" {
+		return "No quiet hours, use /quiet 23:00-07:00 Europe/Berlin to set them"
+	}
+	timezone := subscription.QuietTimezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	text := "Quiet hours: " + strings.ReplaceAll(subscription.QuietHours, ",", ", ") + " (" + timezone + ")\n"
+	if subscription.QuietMode == quietDigest {
+		text += "Notifications are held and sent as a digest when the quiet hours end"
+	} else {
+		text += "Notifications are sent silently"
+	}
+	return text + "; those sent with priority=high are not affected"
+}
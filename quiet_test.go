@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuietHours(t *testing.T) {
+	windows, err := parseQuietHours("23:00-07:00,12:30-13:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 2 || windows[0].String() != "23:00-07:00" || windows[1].String() != "12:30-13:00" {
+		t.Errorf("parseQuietHours() = %v", windows)
+	}
+	for _, spec := range []string{"23:00", "25:00-07:00", "07:00-07:00", "23:00-07:00,"} {
+		if _, err := parseQuietHours(spec); err == nil {
+			t.Errorf("parseQuietHours(%q) accepted", spec)
+		}
+	}
+}
+
+func TestQuietUntil(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	subscription := &Subscription{QuietHours: "23:00-07:00", QuietTimezone: "Europe/Berlin"}
+	tests := []struct {
+		now   time.Time
+		quiet bool
+		until time.Time
+	}{
+		{time.Date(2025, 5, 1, 23, 30, 0, 0, berlin), true, time.Date(2025, 5, 2, 7, 0, 0, 0, berlin)},
+		{time.Date(2025, 5, 2, 6, 59, 0, 0, berlin), true, time.Date(2025, 5, 2, 7, 0, 0, 0, berlin)},
+		{time.Date(2025, 5, 2, 7, 0, 0, 0, berlin), false, time.Time{}},
+		// 21:30 UTC is 23:30 in Berlin.
+		{time.Date(2025, 5, 1, 21, 30, 0, 0, time.UTC), true, time.Date(2025, 5, 2, 7, 0, 0, 0, berlin)},
+	}
+	for _, test := range tests {
+		until, quiet := quietUntil(subscription, test.now)
+		if quiet != test.quiet || !until.Equal(test.until) {
+			t.Errorf("quietUntil(%v) = %v, %v, want %v, %v", test.now, until, quiet, test.until, test.quiet)
+		}
+	}
+}
+
+func TestApplyQuietHours(t *testing.T) {
+	openTestDB(t)
+	db.Create(&Subscription{ChatID: 1, UUID: "u1", QuietHours: "00:00-23:59", QuietMode: quietSilent})
+	db.Create(&Subscription{ChatID: 2, UUID: "u2", QuietHours: "00:00-23:59", QuietMode: quietDigest})
+	now := time.Now().UTC().Truncate(24 * time.Hour).Add(12 * time.Hour)
+
+	silent := Delivery{ChatID: 1, Kind: deliveryKindText, Text: "disk 80%"}
+	if !applyQuietHours(&silent, now) || !silent.Silent {
+		t.Errorf("silent mode: sent %v, silent %v", silent.Status, silent.Silent)
+	}
+
+	held := Delivery{ChatID: 2, Kind: deliveryKindText, Text: "disk 80%"}
+	enqueueDelivery(&held)
+	if applyQuietHours(&held, now) || held.Status != deliveryHeld || !held.NextAttemptAt.After(now) {
+		t.Errorf("digest mode: status %q until %v", held.Status, held.NextAttemptAt)
+	}
+
+	urgent := Delivery{ChatID: 2, Kind: deliveryKindText, Text: "disk full", Priority: priorityHigh}
+	if !applyQuietHours(&urgent, now) || urgent.Silent {
+		t.Error("high priority delivery was held or silenced")
+	}
+}
+
+func TestReleaseHeldDeliveries(t *testing.T) {
+	openTestDB(t)
+	db.Create(&Subscription{ChatID: 1, UUID: "u1", QuietHours: "23:00-07:00", QuietMode: quietDigest})
+	var ids []uint
+	for _, delivery := range []Delivery{
+		{ChatID: 1, Kind: deliveryKindText, Format: "markdown", Text: "**disk** 80%"},
+		{ChatID: 1, Kind: deliveryKindText, Format: "markdown", Text: "**disk** 90%"},
+		{ChatID: 1, Kind: deliveryKindText, Format: "markdown", Text: "Deploy?", Buttons: [][]Button{{{Text: "Yes", CallbackData: "yes"}}}},
+	} {
+		enqueueDelivery(&delivery)
+		db.Model(&Delivery{}).Where("id = ?", delivery.ID).Updates(map[string]interface{}{"status": deliveryHeld, "next_attempt_at": time.Now().Add(-time.Minute)})
+		ids = append(ids, delivery.ID)
+	}
+	releaseHeldDeliveries(time.Now())
+
+	var deliveries []Delivery
+	db.Order("id").Find(&deliveries)
+	if len(deliveries) != 4 {
+		t.Fatalf("got %d deliveries, want 3 and a digest", len(deliveries))
+	}
+	digest := deliveries[3]
+	if digest.Status != deliveryQueued || digest.Format != "markdown" || !strings.Contains(digest.Text, "2 notifications") || !strings.Contains(digest.Text, "**disk** 80%") || !strings.Contains(digest.Text, "**disk** 90%") {
+		t.Errorf("digest = %+v", digest)
+	}
+	for _, delivery := range deliveries[:2] {
+		if delivery.Status != deliveryDigested || delivery.DigestID != digest.UUID {
+			t.Errorf("held delivery = %q, digest %q", delivery.Status, delivery.DigestID)
+		}
+	}
+	if deliveries[2].Status != deliveryQueued {
+		t.Errorf("delivery with buttons = %q, want it queued on its own", deliveries[2].Status)
+	}
+}
+
+func TestQueueDigestOnce(t *testing.T) {
+	openTestDB(t)
+	var held []Delivery
+	for _, text := range []string{"disk 80%", "disk 90%"} {
+		delivery := Delivery{ChatID: 1, Kind: deliveryKindText, Text: text}
+		enqueueDelivery(&delivery)
+		db.Model(&Delivery{}).Where("id = ?", delivery.ID).Update("status", deliveryHeld)
+		held = append(held, delivery)
+	}
+	// Two releases that loaded the same held deliveries, e.g. /quiet off and
+	// the ticker, queue a single digest.
+	for i := 0; i < 2; i++ {
+		if err := queueDigest(held); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var digests int64
+	db.Model(&Delivery{}).Where("status = ?", deliveryQueued).Count(&digests)
+	if digests != 1 {
+		t.Errorf("queued %d digests, want 1", digests)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+// rateWindow allows limit messages in any period long sliding window.
+type rateWindow struct {
+	limit  int
+	period time.Duration
+}
+
+// Limits documented in the Telegram Bot FAQ.
+var (
+	globalRate   = rateWindow{limit: 30, period: time.Second}
+	perChatRate  = rateWindow{limit: 1, period: time.Second}
+	perGroupRate = rateWindow{limit: 20, period: time.Minute}
+)
+
+// wait reports how long until another message fits into the window, given
+// the send times that are still inside it.
+func (w rateWindow) wait(sent []time.Time, now time.Time) time.Duration {
+	if len(sent) < w.limit {
+		return 0
+	}
+	return sent[len(sent)-w.limit].Add(w.period).Sub(now)
+}
+
+func chatRates(chatID int64) []rateWindow {
+	// Groups, supergroups and channels have negative IDs.
+	if chatID < 0 {
+		return []rateWindow{perChatRate, perGroupRate}
+	}
+	return []rateWindow{perChatRate}
+}
+
+type rateLimiter struct {
+	mu     sync.Mutex
+	global []time.Time
+	chats  map[int64][]time.Time
+	paused map[int64]time.Time
+}
+
+var limiter = newRateLimiter()
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		chats:  make(map[int64][]time.Time),
+		paused: make(map[int64]time.Time),
+	}
+}
+
+func pruneSendTimes(sent []time.Time, now time.Time, period time.Duration) []time.Time {
+	i := 0
+	for i < len(sent) && now.Sub(sent[i]) >= period {
+		i++
+	}
+	return sent[i:]
+}
+
+// check reports how long the caller has to wait at now before it may send a
+// message to chatID. If no wait is needed and take is set, the send is
+// recorded.
+func (l *rateLimiter) check(chatID int64, take bool, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until, ok := l.paused[chatID]; ok {
+		if now.Before(until) {
+			return until.Sub(now)
+		}
+		delete(l.paused, chatID)
+	}
+	sent := pruneSendTimes(l.chats[chatID], now, perGroupRate.period)
+	l.chats[chatID] = sent
+	for _, window := range chatRates(chatID) {
+		if wait := window.wait(pruneSendTimes(sent, now, window.period), now); wait > 0 {
+			return wait
+		}
+	}
+	l.global = pruneSendTimes(l.global, now, globalRate.period)
+	if wait := globalRate.wait(l.global, now); wait > 0 {
+		return wait
+	}
+	if take {
+		l.chats[chatID] = append(sent, now)
+		l.global = append(l.global, now)
+	}
+	return 0
+}
+
+// delay reports how long a message to chatID would currently have to wait.
+func (l *rateLimiter) delay(chatID int64) time.Duration {
+	return l.check(chatID, false, time.Now())
+}
+
+// wait blocks until a message may be sent to chatID and records it.
+func (l *rateLimiter) wait(chatID int64) {
+	for {
+		wait := l.check(chatID, true, time.Now())
+		if wait <= 0 {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// pause holds back every message to chatID for d.
+func (l *rateLimiter) pause(chatID int64, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until := time.Now().Add(d)
+	if until.After(l.paused[chatID]) {
+		l.paused[chatID] = until
+	}
+	logger.Info("Pausing chat after flood control", zap.Int64("chatID", chatID), zap.Duration("retry_after", d))
+}
+
+// retryAfter extracts the flood control delay from a Telegram error.
+func retryAfter(err error) time.Duration {
+	var apiErr *tgbotapi.Error
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return time.Duration(apiErr.RetryAfter) * time.Second
+	}
+	return 0
+}
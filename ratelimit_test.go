@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestRateLimiterPerChat(t *testing.T) {
+	l := newRateLimiter()
+	start := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	if wait := l.check(1, true, start); wait != 0 {
+		t.Fatalf("first message waits %v", wait)
+	}
+	if wait := l.check(1, false, start.Add(400*time.Millisecond)); wait != 600*time.Millisecond {
+		t.Errorf("second message in the same second waits %v, want 600ms", wait)
+	}
+	if wait := l.check(2, false, start.Add(400*time.Millisecond)); wait != 0 {
+		t.Errorf("message to another chat waits %v", wait)
+	}
+	if wait := l.check(1, false, start.Add(time.Second)); wait != 0 {
+		t.Errorf("message a second later waits %v", wait)
+	}
+	// Checking without take does not count as a send.
+	if wait := l.check(1, false, start.Add(time.Second)); wait != 0 {
+		t.Errorf("check without take was recorded: %v", wait)
+	}
+}
+
+func TestRateLimiterPerGroup(t *testing.T) {
+	l := newRateLimiter()
+	start := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		if wait := l.check(-100, true, start.Add(time.Duration(i)*time.Second)); wait != 0 {
+			t.Fatalf("message %d waits %v", i+1, wait)
+		}
+	}
+	if wait := l.check(-100, false, start.Add(20*time.Second)); wait != 40*time.Second {
+		t.Errorf("21st message in a minute waits %v, want 40s", wait)
+	}
+	if wait := l.check(-100, false, start.Add(time.Minute)); wait != 0 {
+		t.Errorf("message after a minute waits %v", wait)
+	}
+	// Private chats only have the per-chat limit.
+	for i := 0; i < 21; i++ {
+		if wait := l.check(1, true, start.Add(time.Duration(i)*time.Second)); wait != 0 {
+			t.Fatalf("message %d to a private chat waits %v", i+1, wait)
+		}
+	}
+}
+
+func TestRateLimiterGlobal(t *testing.T) {
+	l := newRateLimiter()
+	start := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 30; i++ {
+		if wait := l.check(int64(i+1), true, start.Add(time.Duration(i)*time.Millisecond)); wait != 0 {
+			t.Fatalf("message %d waits %v", i+1, wait)
+		}
+	}
+	if wait := l.check(100, false, start.Add(30*time.Millisecond)); wait != 970*time.Millisecond {
+		t.Errorf("31st message in a second waits %v, want 970ms", wait)
+	}
+	if wait := l.check(100, false, start.Add(time.Second)); wait != 0 {
+		t.Errorf("message a second later waits %v", wait)
+	}
+}
+
+func TestRateLimiterPause(t *testing.T) {
+	l := newRateLimiter()
+	l.pause(1, 5*time.Second)
+	now := time.Now()
+	if wait := l.check(1, true, now); wait <= 4*time.Second || wait > 5*time.Second {
+		t.Errorf("paused chat waits %v, want about 5s", wait)
+	}
+	if wait := l.check(2, true, now); wait != 0 {
+		t.Errorf("other chat waits %v", wait)
+	}
+	// A shorter pause does not cut a longer one short.
+	l.pause(1, time.Second)
+	if wait := l.check(1, false, now); wait <= 4*time.Second {
+		t.Errorf("shorter pause replaced the longer one: %v", wait)
+	}
+	if wait := l.check(1, false, now.Add(5*time.Second)); wait != 0 {
+		t.Errorf("chat still paused after retry_after: %v", wait)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	flood := &tgbotapi.Error{Code: 429, Message: "Too Many Requests: retry after 7", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 7}}
+	tests := []struct {
+		err  error
+		want time.Duration
+	}{
+		{flood, 7 * time.Second},
+		{fmt.Errorf("send message: %w", flood), 7 * time.Second},
+		{&tgbotapi.Error{Code: 400, Message: "Bad Request: chat not found"}, 0},
+		{errors.New("connection reset by peer"), 0},
+		{nil, 0},
+	}
+	for _, test := range tests {
+		if got := retryAfter(test.err); got != test.want {
+			t.Errorf("retryAfter(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
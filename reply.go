@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+// ReplyEvent is posted to the reply webhook of a subscription when someone
+// replies to one of its notifications in Telegram.
+type ReplyEvent struct {
+	DeliveryID       string      `json:"delivery_id"`
+	CorrelationKey   string      `json:"correlation_key,omitempty"`
+	ChatID           int64       `json:"chat_id"`
+	MessageID        int         `json:"message_id"`
+	ReplyToMessageID int         `json:"reply_to_message_id"`
+	Text             string      `json:"text"`
+	User             WebhookUser `json:"user"`
+	SentAt           time.Time   `json:"sent_at"`
+}
+
+// isReplyToBot reports whether message replies to a message of the bot.
+func isReplyToBot(message *tgbotapi.Message) bool {
+	return message.ReplyToMessage != nil && message.ReplyToMessage.From != nil && message.ReplyToMessage.From.ID == bot.Self.ID
+}
+
+// processReply posts a reply to a notification to the reply webhook of the
+// chat's subscription. Replies to other messages of the bot are ignored.
+func processReply(message *tgbotapi.Message) {
+	var subscription Subscription
+	db.First(&subscription, "chat_id = ?", message.Chat.ID)
+	if subscription.ReplyWebhook == "" {
+		return
+	}
+	var sent SentMessage
+	if err := db.Where("chat_id = ? AND message_id = ?", message.Chat.ID, message.ReplyToMessage.MessageID).First(&sent).Error; err != nil {
+		return
+	}
+	var delivery Delivery
+	if err := db.First(&delivery, sent.DeliveryID).Error; err != nil {
+		logger.Error("Failed to load delivery of reply", zap.Uint("id", sent.DeliveryID), zap.Error(err))
+		return
+	}
+	text := message.Text
+	if text == "" {
+		text = message.Caption
+	}
+	event := ReplyEvent{
+		DeliveryID:       delivery.UUID,
+		CorrelationKey:   delivery.CorrelationKey,
+		ChatID:           message.Chat.ID,
+		MessageID:        message.MessageID,
+		ReplyToMessageID: message.ReplyToMessage.MessageID,
+		Text:             text,
+		User:             newWebhookUser(message.From),
+		SentAt:           message.Time(),
+	}
+	if err := postWebhook(subscription.ReplyWebhook, &subscription, event); err != nil {
+		logger.Error("Failed to post reply to webhook", zap.String("delivery", delivery.UUID), zap.Error(err))
+	}
+}
+
+// handleReplyWebhook shows, sets or, with "off", removes the webhook that
+// receives replies to the notifications of chatID.
+func handleReplyWebhook(chatID int64, managerID int64, args []string) {
+	var subscription Subscription
+	db.First(&subscription, "chat_id = ?", chatID)
+	if subscription.UUID == "" {
+		bot.Send(tgbotapi.NewMessage(managerID, "Invalid UUID or not subscribed"))
+		return
+	}
+	if len(args) > 1 {
+		bot.Send(tgbotapi.NewMessage(managerID, "Usage: /reply_webhook [url|off]"))
+		return
+	}
+	if len(args) == 1 {
+		if strings.ToLower(args[0]) == "off" {
+			subscription.ReplyWebhook = ""
+		} else if err := checkWebhookURL(args[0]); err != nil {
+			bot.Send(tgbotapi.NewMessage(managerID, "Invalid webhook: "+err.Error()))
+			return
+		} else {
+			subscription.ReplyWebhook = args[0]
+		}
+		if err := saveSubscription(&subscription); err != nil {
+			logger.Error("Failed to save reply webhook", zap.Error(err))
+			bot.Send(tgbotapi.NewMessage(managerID, "Failed to save reply webhook"))
+			return
+		}
+	}
+	if subscription.ReplyWebhook == "" {
+		bot.Send(tgbotapi.NewMessage(managerID, "Replies to notifications are not forwarded, use /reply_webhook <url> to forward them"))
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(managerID, "Replies to notifications are posted to "+subscription.ReplyWebhook))
+}
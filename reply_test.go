@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestProcessReply(t *testing.T) {
+	openTestDB(t)
+	config.WebhookTimeout = time.Second
+	events := make(chan ReplyEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(signatureHeader) != signForTest(testAESKey, r.Header.Get(timestampHeader), body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		var event ReplyEvent
+		json.Unmarshal(body, &event)
+		events <- event
+	}))
+	defer server.Close()
+
+	db.Create(&Subscription{ChatID: 1, UUID: "u1", AESKey: testAESKey, ReplyWebhook: server.URL})
+	delivery := Delivery{ChatID: 1, Kind: deliveryKindText, Text: "Disk full", CorrelationKey: "INC-1042"}
+	if err := enqueueDelivery(&delivery); err != nil {
+		t.Fatal(err)
+	}
+	db.Create(&SentMessage{DeliveryID: delivery.ID, ChatID: 1, MessageID: 42})
+
+	reply := func(messageID int) *tgbotapi.Message {
+		return &tgbotapi.Message{
+			MessageID:      100,
+			Chat:           &tgbotapi.Chat{ID: 1},
+			From:           &tgbotapi.User{ID: 7, UserName: "alice"},
+			Text:           "Looking into it",
+			ReplyToMessage: &tgbotapi.Message{MessageID: messageID},
+		}
+	}
+	processReply(reply(42))
+	select {
+	case event := <-events:
+		if event.DeliveryID != delivery.UUID || event.CorrelationKey != "INC-1042" || event.ReplyToMessageID != 42 || event.Text != "Looking into it" || event.User.UserName != "alice" {
+			t.Errorf("webhook got %+v", event)
+		}
+	default:
+		t.Fatal("reply was not posted")
+	}
+
+	processReply(reply(43))
+	select {
+	case event := <-events:
+		t.Errorf("reply to an unknown message was posted: %+v", event)
+	default:
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+// maxScheduleAhead bounds how far ahead a message can be scheduled.
+const maxScheduleAhead = 366 * 24 * time.Hour
+
+// scheduledListLimit is how many scheduled messages /scheduled shows.
+const scheduledListLimit = 20
+
+// messageSendAt returns when msg asks to be sent, given by its send_at or
+// delay field, or nil to send it now. A time in the past sends it now, too.
+func messageSendAt(msg *Message, now time.Time) (*time.Time, error) {
+	if msg.SendAt != "" && msg.Delay != "" {
+		return nil, fmt.Errorf("send_at and delay cannot be combined")
+	}
+	var sendAt time.Time
+	switch {
+	case msg.SendAt != "":
+		t, err := time.Parse(time.RFC3339, msg.SendAt)
+		if err != nil {
+			return nil, fmt.Errorf("send_at must be an RFC 3339 time, e.g. 2024-05-01T18:00:00+02:00")
+		}
+		sendAt = t
+	case msg.Delay != "":
+		delay, err := time.ParseDuration(msg.Delay)
+		if err != nil || delay < 0 {
+			return nil, fmt.Errorf("delay must be a positive duration, e.g. 10m or 1h30m")
+		}
+		sendAt = now.Add(delay)
+	default:
+		return nil, nil
+	}
+	if sendAt.Sub(now) > maxScheduleAhead {
+		return nil, fmt.Errorf("messages can be scheduled at most a year ahead")
+	}
+	if !sendAt.After(now) {
+		return nil, nil
+	}
+	return &sendAt, nil
+}
+
+func startScheduler() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			releaseScheduledDeliveries(now)
+		}
+	}()
+}
+
+// releaseScheduledDeliveries queues the scheduled deliveries that are due.
+// Those that came due while the server was down are queued on the first
+// run.
+func releaseScheduledDeliveries(now time.Time) {
+	released := db.Model(&Delivery{}).Where("status = ? AND next_attempt_at <= ?", deliveryScheduled, now).Update("status", deliveryQueued)
+	if released.Error != nil {
+		logger.Error("Failed to release scheduled deliveries", zap.Error(released.Error))
+		return
+	}
+	if released.RowsAffected > 0 {
+		logger.Debug("Released scheduled deliveries", zap.Int64("count", released.RowsAffected))
+		queue.notify()
+	}
+}
+
+// scheduledDeliveries returns the scheduled deliveries of chatID, the next
+// one first.
+func scheduledDeliveries(chatID int64, limit int) ([]Delivery, int64, error) {
+	query := db.Model(&Delivery{}).Where("chat_id = ? AND status = ?", chatID, deliveryScheduled)
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	deliveries := []Delivery{}
+	err := query.Order("next_attempt_at, id").Limit(limit).Find(&deliveries).Error
+	return deliveries, total, err
+}
+
+// handleScheduledList lists the scheduled messages of the subscription, the
+// next one first. They are cancelled like any other message, with DELETE
+// /api/:uuid/messages/:id.
+func handleScheduledList(c *gin.Context) {
+	realIP := getRealIP(c)
+	subscription, err := checkAuthorization(c)
+	if err != nil {
+		respondAuthorizationError(c, realIP, err)
+		return
+	}
+	deliveries, total, err := scheduledDeliveries(subscription.ChatID, 100)
+	if err != nil {
+		logger.Error("Failed to list scheduled deliveries", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Failed to load messages",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"messages": deliveries,
+		"total":    total,
+	})
+}
+
+// excerpt shortens text to its first line of at most n characters.
+func excerpt(text string, n int) string {
+	line, _, cut := strings.Cut(strings.TrimSpace(text), "\n")
+	if utf8.RuneCountInString(line) > n {
+		line = string([]rune(line)[:n])
+		cut = true
+	}
+	if cut {
+		line += "…"
+	}
+	return line
+}
+
+// handleScheduled lists the scheduled messages of chatID, or cancels one:
+// /scheduled cancel <ID>, where the ID is the delivery ID or its beginning
+// as listed.
+func handleScheduled(chatID int64, managerID int64, args []string) {
+	var subscription Subscription
+	db.First(&subscription, "chat_id = ?", chatID)
+	if subscription.UUID == "" {
+		bot.Send(tgbotapi.NewMessage(managerID, "Invalid UUID or not subscribed"))
+		return
+	}
+	if len(args) > 0 {
+		if len(args) != 2 || strings.ToLower(args[0]) != "cancel" {
+			bot.Send(tgbotapi.NewMessage(managerID, "Usage: /scheduled [cancel <ID>]"))
+			return
+		}
+		cancelScheduled(chatID, managerID, args[1])
+		return
+	}
+	deliveries, total, err := scheduledDeliveries(chatID, scheduledListLimit)
+	if err != nil {
+		logger.Error("Failed to list scheduled deliveries", zap.Error(err))
+		bot.Send(tgbotapi.NewMessage(managerID, "Failed to load scheduled messages"))
+		return
+	}
+	if total == 0 {
+		bot.Send(tgbotapi.NewMessage(managerID, "No scheduled messages"))
+		return
+	}
+	location := subscriptionLocation(&subscription)
+	text := "Scheduled messages:\n\n"
+	for _, delivery := range deliveries {
+		text += delivery.UUID[:8] + "  " + delivery.NextAttemptAt.In(location).Format("2006-01-02 15:04 MST") + "\n"
+		text += "  " + excerpt(delivery.Text, 60) + "\n"
+	}
+	if total > int64(len(deliveries)) {
+		text += "\nand " + strconv.FormatInt(total-int64(len(deliveries)), 10) + " more\n"
+	}
+	text += "\nUse /scheduled cancel <ID> to cancel one"
+	bot.Send(tgbotapi.NewMessage(managerID, text))
+}
+
+func cancelScheduled(chatID int64, managerID int64, id string) {
+	var deliveries []Delivery
+	db.Where("chat_id = ? AND status = ? AND uuid LIKE ?", chatID, deliveryScheduled, strings.ToLower(id)+"%").Limit(2).Find(&deliveries)
+	if len(id) < 8 || len(deliveries) != 1 {
+		bot.Send(tgbotapi.NewMessage(managerID, "No scheduled message "+id+", see /scheduled"))
+		return
+	}
+	if err := deleteDelivery(&deliveries[0]); err != nil {
+		bot.Send(tgbotapi.NewMessage(managerID, "Failed to cancel message: "+err.Error()))
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(managerID, "Cancelled scheduled message "+deliveries[0].UUID[:8]))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageSendAt(t *testing.T) {
+	now := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		msg  Message
+		want time.Time
+	}{
+		{Message{SendAt: "2025-05-01T16:00:00+02:00"}, time.Date(2025, 5, 1, 14, 0, 0, 0, time.UTC)},
+		{Message{Delay: "1h30m"}, time.Date(2025, 5, 1, 13, 30, 0, 0, time.UTC)},
+		// No schedule, or a time that has passed, sends the message now.
+		{Message{}, time.Time{}},
+		{Message{SendAt: "2025-05-01T11:00:00Z"}, time.Time{}},
+	}
+	for _, test := range tests {
+		sendAt, err := messageSendAt(&test.msg, now)
+		if err != nil {
+			t.Errorf("messageSendAt(%+v) failed: %v", test.msg, err)
+			continue
+		}
+		if (sendAt == nil) != test.want.IsZero() || (sendAt != nil && !sendAt.Equal(test.want)) {
+			t.Errorf("messageSendAt(%+v) = %v, want %v", test.msg, sendAt, test.want)
+		}
+	}
+	for _, msg := range []Message{
+		{SendAt: "tomorrow"},
+		{Delay: "-5m"},
+		{Delay: "10"},
+		{Delay: "9000h"},
+		{SendAt: "2025-05-01T16:00:00Z", Delay: "5m"},
+	} {
+		if _, err := messageSendAt(&msg, now); err == nil {
+			t.Errorf("messageSendAt(%+v) accepted", msg)
+		}
+	}
+}
+
+func TestScheduledDeliveries(t *testing.T) {
+	openTestDB(t)
+	later := time.Now().Add(time.Hour)
+	scheduled := Delivery{ChatID: 1, Kind: deliveryKindText, Text: "maintenance starts in 10 min", SendAt: &later}
+	enqueueDelivery(&scheduled)
+	if scheduled.Status != deliveryScheduled || !scheduled.NextAttemptAt.Equal(later) {
+		t.Fatalf("status %q, next attempt %v", scheduled.Status, scheduled.NextAttemptAt)
+	}
+	cancelled := Delivery{ChatID: 1, Kind: deliveryKindText, Text: "never mind", SendAt: &later}
+	enqueueDelivery(&cancelled)
+	if err := deleteDelivery(&cancelled); err != nil || cancelled.Status != deliveryDeleted {
+		t.Fatalf("cancel: %v, status %q", err, cancelled.Status)
+	}
+
+	releaseScheduledDeliveries(time.Now())
+	db.First(&scheduled, scheduled.ID)
+	if scheduled.Status != deliveryScheduled {
+		t.Errorf("released before its time: %q", scheduled.Status)
+	}
+	releaseScheduledDeliveries(later)
+	db.First(&scheduled, scheduled.ID)
+	db.First(&cancelled, cancelled.ID)
+	if scheduled.Status != deliveryQueued || cancelled.Status != deliveryDeleted {
+		t.Errorf("after release: %q and cancelled %q", scheduled.Status, cancelled.Status)
+	}
+}
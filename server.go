@@ -19,6 +19,7 @@ var config Config
 var config_path = flag.String("conf", "config.toml", "Path to config file")
 var db_path = flag.String("db", "subscriptions.db", "Path to database file")
 var article_db_path = flag.String("article-db", "articles.db", "Path to article database file")
+var spool_path = flag.String("spool", "", "Path to spool directory for queued files (default: next to the database)")
 var log_path = flag.String("log", "log.log", "Path to log file")
 var save_log = flag.Bool("save-log", false, "Save log to file")
 var verbose = flag.Bool("verbose", false, "Enable verbose logging")
@@ -42,6 +43,7 @@ func main() {
 		logger.Fatal("Failed to parse config file:", zap.Error(err))
 		panic(err)
 	}
+	applyConfigDefaults(&config)
 
 	logger.Info("Telegram API URL: " + config.TelegramAPIURL)
 	logger.Info("Post URL: " + config.PostURL)
@@ -49,10 +51,18 @@ func main() {
 
 	// Initialize the database and bot
 	initDB()
+	initSpool(*spool_path)
 	initBot(config.TelegramToken, config.TelegramAPIURL)
 	initMarkdownRender()
+	startDeliveryQueue(config.QueueWorkers)
+	startGraceReminders()
+	startQuietHours()
+	startScheduler()
+	startAlertGroups()
 
-	router := gin.Default()
+	// gin.Default would also log every path, UUID included.
+	router := gin.New()
+	router.Use(gin.Recovery())
 
 	router.Use(loggerGinMiddleware())
 	router.Use(enableCors())
@@ -75,6 +85,15 @@ func main() {
 	apiGroup.GET("/:uuid/get", handleGet)
 	apiGroup.POST("/:uuid/form", handleForm)
 	apiGroup.POST("/:uuid/file", handleFile)
+	apiGroup.POST("/:uuid/album", handleAlbum)
+	apiGroup.POST("/:uuid/batch", handleBatch)
+	apiGroup.GET("/:uuid/messages", handleMessageList)
+	apiGroup.GET("/:uuid/scheduled", handleScheduledList)
+	apiGroup.GET("/:uuid/messages/:id", handleMessageStatus)
+	apiGroup.PATCH("/:uuid/messages/:id", handleMessageEdit)
+	apiGroup.DELETE("/:uuid/messages/:id", handleMessageDelete)
+	apiGroup.POST("/topic/:topic/json", handleTopicJSON)
+	apiGroup.GET("/topic/:topic/messages/:id", handleTopicPublication)
 
 	articleGroup := router.Group("/html")
 	articleGroup.GET("/:uuid", handleHTML)
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	signatureHeader = "X-Signature"
+	timestampHeader = "X-Timestamp"
+)
+
+// signedBodyMemory is how much of a signed request body is buffered in
+// memory; larger bodies are buffered in a temporary file.
+const signedBodyMemory = 1 << 20
+
+// authorizationError is returned by checkAuthorization with the status the
+// request is answered with.
+type authorizationError struct {
+	status  int
+	message string
+}
+
+func (e *authorizationError) Error() string {
+	return e.message
+}
+
+var errNotSubscribed = &authorizationError{http.StatusNotFound, "Invalid UUID or not subscribed"}
+
+func signatureFailure(message string) *authorizationError {
+	return &authorizationError{http.StatusUnauthorized, message}
+}
+
+func respondAuthorizationError(c *gin.Context, realIP string, err error) {
+	status := http.StatusNotFound
+	if authErr, ok := err.(*authorizationError); ok {
+		status = authErr.status
+	}
+	logger.Error("Unauthorized request from "+realIP, zap.Error(err))
+	c.JSON(status, gin.H{
+		"message": err.Error(),
+	})
+}
+
+// signingKey is the HMAC key of a subscription: its signing secret if one
+// was generated, its AES key otherwise.
+func signingKey(subscription *Subscription) string {
+	if subscription.SigningSecret != "" {
+		return subscription.SigningSecret
+	}
+	return subscription.AESKey
+}
+
+// previousSigningKey is the HMAC key that was replaced by /regenerate.
+func previousSigningKey(subscription *Subscription) string {
+	if subscription.PreviousSigningSecret != "" {
+		return subscription.PreviousSigningSecret
+	}
+	return subscription.PreviousAESKey
+}
+
+// replayCache remembers the signatures seen within the signature window, so
+// that a captured request cannot be sent again while its timestamp is valid.
+type replayCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+var signatures = replayCache{seen: make(map[string]time.Time)}
+
+// remember records signature until expires and reports whether it was new.
+func (r *replayCache) remember(signature string, expires time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for s, until := range r.seen {
+		if now.After(until) {
+			delete(r.seen, s)
+		}
+	}
+	if _, ok := r.seen[signature]; ok {
+		return false
+	}
+	r.seen[signature] = expires
+	return true
+}
+
+// verifySignature checks the X-Signature header of a request, the hex
+// encoded HMAC-SHA256 of the X-Timestamp header followed by the request
+// body, or by the raw query for GET requests. Requests without a signature
+// pass unless the subscription requires one. During the grace period after
+// /regenerate, the replaced key is accepted too.
+func verifySignature(c *gin.Context, subscription *Subscription) error {
+	signature := c.GetHeader(signatureHeader)
+	timestamp := c.GetHeader(timestampHeader)
+	if signature == "" && timestamp == "" {
+		if subscription.RequireSignature {
+			return signatureFailure("Signature required")
+		}
+		return nil
+	}
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return signatureFailure("Invalid timestamp")
+	}
+	signedAt := time.Unix(sent, 0)
+	if age := time.Since(signedAt); age > config.SignatureWindow || age < -config.SignatureWindow {
+		return signatureFailure("Timestamp outside the signature window")
+	}
+	given, err := hex.DecodeString(signature)
+	if err != nil {
+		return signatureFailure("Invalid signature")
+	}
+
+	keys := []string{signingKey(subscription)}
+	if inGracePeriod(subscription) {
+		keys = append(keys, previousSigningKey(subscription))
+	}
+	macs := make([]hash.Hash, len(keys))
+	writers := make([]io.Writer, len(keys))
+	for i, key := range keys {
+		macs[i] = hmac.New(sha256.New, []byte(key))
+		writers[i] = macs[i]
+	}
+	mac := io.MultiWriter(writers...)
+	mac.Write([]byte(timestamp))
+	if c.Request.Method == http.MethodGet {
+		mac.Write([]byte(c.Request.URL.RawQuery))
+	} else if err := readSignedBody(c, mac); err != nil {
+		logger.Error("Failed to read signed body", zap.Error(err))
+		return signatureFailure("Failed to read body")
+	}
+	matched := -1
+	for i := range macs {
+		if hmac.Equal(given, macs[i].Sum(nil)) {
+			matched = i
+			break
+		}
+	}
+	if matched < 0 {
+		return signatureFailure("Invalid signature")
+	}
+	if matched > 0 {
+		subscription.usedPreviousCredentials = true
+	}
+	if !signatures.remember(hex.EncodeToString(given), signedAt.Add(config.SignatureWindow)) {
+		return signatureFailure("Signature already used")
+	}
+	return nil
+}
+
+// readSignedBody feeds the request body into mac and puts a copy back, so
+// that the handler can still bind it. Bodies larger than signedBodyMemory
+// are copied to a temporary file that is removed when the request ends.
+func readSignedBody(c *gin.Context, mac io.Writer) error {
+	body := c.Request.Body
+	if body == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(io.MultiWriter(&buf, mac), body, signedBodyMemory); err == io.EOF {
+		c.Request.Body = io.NopCloser(&buf)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(spoolDir, "body-*")
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-c.Request.Context().Done()
+		file.Close()
+		removeSpoolFile(file.Name())
+	}()
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.MultiWriter(file, mac), body); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind body: %w", err)
+	}
+	c.Request.Body = io.NopCloser(file)
+	return nil
+}
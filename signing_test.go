@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func signForTest(key string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newSignedContext(method string, target string, body []byte, timestamp string, signature string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(method, target, bytes.NewReader(body))
+	if timestamp != "" {
+		c.Request.Header.Set(timestampHeader, timestamp)
+	}
+	if signature != "" {
+		c.Request.Header.Set(signatureHeader, signature)
+	}
+	return c
+}
+
+func TestVerifySignature(t *testing.T) {
+	config.SignatureWindow = 5 * time.Minute
+	spoolDir = t.TempDir()
+	subscription := &Subscription{AESKey: testAESKey}
+	body := []byte(`{"msg":"hello"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		timestamp  string
+		signature  string
+		require    bool
+		wantStatus int
+	}{
+		{"unsigned", http.MethodPost, "/", "", "", false, 0},
+		{"unsigned but required", http.MethodPost, "/", "", "", true, http.StatusUnauthorized},
+		{"signed body", http.MethodPost, "/", now, signForTest(testAESKey, now, body), true, 0},
+		{"signed query", http.MethodGet, "/?msg=hi", now, signForTest(testAESKey, now, []byte("msg=hi")), true, 0},
+		{"wrong key", http.MethodPost, "/", now, signForTest("other", now, body), false, http.StatusUnauthorized},
+		{"expired", http.MethodPost, "/", old, signForTest(testAESKey, old, body), false, http.StatusUnauthorized},
+		{"bad timestamp", http.MethodPost, "/", "yesterday", signForTest(testAESKey, "yesterday", body), false, http.StatusUnauthorized},
+		{"not hex", http.MethodPost, "/", now, "zz", false, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signatures = replayCache{seen: make(map[string]time.Time)}
+			subscription.RequireSignature = tt.require
+			c := newSignedContext(tt.method, tt.target, body, tt.timestamp, tt.signature)
+			err := verifySignature(c, subscription)
+			status := 0
+			if err != nil {
+				status = err.(*authorizationError).status
+			}
+			if status != tt.wantStatus {
+				t.Fatalf("verifySignature() = %v, want status %d", err, tt.wantStatus)
+			}
+			if got, _ := io.ReadAll(c.Request.Body); err == nil && tt.method == http.MethodPost && !bytes.Equal(got, body) {
+				t.Errorf("body after verification = %q, want %q", got, body)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureRejectsReplay(t *testing.T) {
+	config.SignatureWindow = 5 * time.Minute
+	signatures = replayCache{seen: make(map[string]time.Time)}
+	subscription := &Subscription{AESKey: testAESKey, SigningSecret: "secret"}
+	body := []byte("msg=hello")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := signForTest("secret", now, body)
+
+	if err := verifySignature(newSignedContext(http.MethodPost, "/", body, now, signature), subscription); err != nil {
+		t.Fatalf("first request rejected: %v", err)
+	}
+	if err := verifySignature(newSignedContext(http.MethodPost, "/", body, now, signature), subscription); err == nil {
+		t.Error("replayed request accepted")
+	}
+}
+
+func TestVerifySignatureLargeBody(t *testing.T) {
+	config.SignatureWindow = 5 * time.Minute
+	signatures = replayCache{seen: make(map[string]time.Time)}
+	spoolDir = t.TempDir()
+	subscription := &Subscription{AESKey: testAESKey}
+	body := bytes.Repeat([]byte("0123456789abcdef"), signedBodyMemory/8)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	c := newSignedContext(http.MethodPost, "/", body, now, signForTest(testAESKey, now, body))
+	if err := verifySignature(c, subscription); err != nil {
+		t.Fatalf("verifySignature() = %v", err)
+	}
+	if got, _ := io.ReadAll(c.Request.Body); !bytes.Equal(got, body) {
+		t.Errorf("body after verification has %d bytes, want %d", len(got), len(body))
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// telegramMessageLimit is the maximum length of a text message, counted in
+// UTF-16 code units like Telegram does.
+const telegramMessageLimit = 4096
+
+const (
+	overflowSplit      = "split"
+	overflowServerHTML = "server-html"
+	overflowTruncate   = "truncate"
+)
+
+func isValidOverflow(overflow string) bool {
+	switch overflow {
+	case "", overflowSplit, overflowServerHTML, overflowTruncate:
+		return true
+	}
+	return false
+}
+
+func utf16Length(text string) int {
+	length := 0
+	for _, r := range text {
+		if r >= 0x10000 {
+			length += 2
+		} else {
+			length++
+		}
+	}
+	return length
+}
+
+// markupScanner walks text that starts with the entities in open still
+// open. It reports before which bytes the text may be cut without breaking
+// markup apart, and which entities are open at the end of text. Entities are
+// identified by the markup that opens them.
+type markupScanner func(text string, open []string) (cuttable []bool, stillOpen []string)
+
+func scannerFor(parseMode string) markupScanner {
+	switch parseMode {
+	case tgbotapi.ModeMarkdownV2:
+		return scanMarkdownV2
+	case tgbotapi.ModeHTML:
+		return scanHTML
+	default:
+		return scanPlain
+	}
+}
+
+// splitMessage cuts text, formatted for parseMode, into messages of at most
+// limit UTF-16 code units. It prefers to cut between paragraphs, then between
+// lines, then between words. Entities that are open at a cut are closed at
+// the end of the message and opened again at the start of the next one, so
+// every message is valid on its own.
+func splitMessage(text string, parseMode string, limit int) []string {
+	scan := scannerFor(parseMode)
+	cuttable, _ := scan(text, nil)
+	var parts []string
+	var open []string
+	offset := 0
+	for {
+		rest := text[offset:]
+		prefix := strings.Join(open, "")
+		if utf16Length(prefix)+utf16Length(rest) <= limit {
+			return append(parts, prefix+rest)
+		}
+		budget := limit - utf16Length(prefix)
+		for {
+			cut, skip := findCut(rest, budget, cuttable[offset:])
+			_, stillOpen := scan(rest[:cut], open)
+			part := prefix + rest[:cut] + closeMarkup(stillOpen, parseMode)
+			if excess := utf16Length(part) - limit; excess > 0 && budget > 1 {
+				budget -= excess
+				continue
+			}
+			parts = append(parts, part)
+			offset += cut + skip
+			open = stillOpen
+			break
+		}
+	}
+}
+
+// findCut picks where to end a message that may hold budget code units of
+// text. It returns the cut position and how many separator bytes after it
+// are dropped.
+func findCut(text string, budget int, cuttable []bool) (int, int) {
+	maxCut := 0
+	units := 0
+	for i, r := range text {
+		width := 1
+		if r >= 0x10000 {
+			width = 2
+		}
+		if units+width > budget {
+			break
+		}
+		units += width
+		maxCut = i + utf8.RuneLen(r)
+	}
+	if maxCut == 0 {
+		_, size := utf8.DecodeRuneInString(text)
+		return size, 0
+	}
+	// Only take a separator from the second half of the budget, unless
+	// there is none at all, so that messages do not get too short.
+	for _, minCut := range []int{maxCut / 2, 0} {
+		for _, separator := range []string{"\n\n", "\n", " "} {
+			for i := strings.LastIndex(text[:maxCut], separator); i > minCut; i = strings.LastIndex(text[:i], separator) {
+				if cuttable[i] && cuttable[i+len(separator)] {
+					return i, len(separator)
+				}
+			}
+		}
+	}
+	for i := maxCut; i > 0; i-- {
+		if cuttable[i] {
+			return i, 0
+		}
+	}
+	return maxCut, 0
+}
+
+func closeMarkup(open []string, parseMode string) string {
+	var out strings.Builder
+	for i := len(open) - 1; i >= 0; i-- {
+		if parseMode == tgbotapi.ModeHTML {
+			out.WriteString("</" + htmlTagName(open[i]) + ">")
+		} else if strings.HasPrefix(open[i], "```") {
+			out.WriteString("\n```")
+		} else {
+			out.WriteString(open[i])
+		}
+	}
+	return out.String()
+}
+
+// newCuttable allows a cut before every rune of text.
+func newCuttable(text string) []bool {
+	cuttable := make([]bool, len(text)+1)
+	for i := range cuttable {
+		cuttable[i] = i == len(text) || utf8.RuneStart(text[i])
+	}
+	return cuttable
+}
+
+func scanPlain(text string, open []string) ([]bool, []string) {
+	return newCuttable(text), open
+}
+
+// toggleMarkup closes entity if it is open and opens it otherwise.
+func toggleMarkup(open []string, entity string) []string {
+	for i := len(open) - 1; i >= 0; i-- {
+		if open[i] == entity {
+			return append(append([]string(nil), open[:i]...), open[i+1:]...)
+		}
+	}
+	return append(append([]string(nil), open...), entity)
+}
+
+func scanMarkdownV2(text string, open []string) ([]bool, []string) {
+	cuttable := newCuttable(text)
+	inLink := false
+	inURL := false
+	i := 0
+	for i < len(text) {
+		if inLink || inURL {
+			cuttable[i] = false
+		}
+		top := ""
+		if len(open) > 0 {
+			top = open[len(open)-1]
+		}
+		rest := text[i:]
+		switch {
+		case rest[0] == '\\' && len(rest) > 1:
+			_, size := utf8.DecodeRuneInString(rest[1:])
+			for j := i + 1; j <= i+size && j < len(cuttable); j++ {
+				cuttable[j] = false
+			}
+			i += 1 + size
+			continue
+		case strings.HasPrefix(top, "```"):
+			if strings.HasPrefix(rest, "```") {
+				open = toggleMarkup(open, top)
+				i += 3
+				continue
+			}
+		case top == "`":
+			if rest[0] == '`' {
+				open = toggleMarkup(open, top)
+			}
+		case inURL:
+			if rest[0] == ')' {
+				inURL = false
+			}
+		case rest[0] == '[':
+			inLink = true
+		case inLink && strings.HasPrefix(rest, "]("):
+			inLink = false
+			inURL = true
+			cuttable[i+1] = false
+			i += 2
+			continue
+		case strings.HasPrefix(rest, "```"):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			for j := i + 1; j <= i+end; j++ {
+				cuttable[j] = false
+			}
+			open = toggleMarkup(open, rest[:end+1])
+			i += end + 1
+			continue
+		case rest[0] == '`':
+			open = toggleMarkup(open, "`")
+		case strings.HasPrefix(rest, "||"), strings.HasPrefix(rest, "__"):
+			open = toggleMarkup(open, rest[:2])
+			cuttable[i+1] = false
+			i += 2
+			continue
+		case rest[0] == '*' || rest[0] == '_' || rest[0] == '~':
+			open = toggleMarkup(open, rest[:1])
+		}
+		i++
+	}
+	return cuttable, open
+}
+
+func htmlTagName(tag string) string {
+	name := strings.TrimLeft(tag, "</")
+	if end := strings.IndexAny(name, " \t\n/>"); end >= 0 {
+		name = name[:end]
+	}
+	return strings.ToLower(name)
+}
+
+func scanHTML(text string, open []string) ([]bool, []string) {
+	cuttable := newCuttable(text)
+	i := 0
+	for i < len(text) {
+		switch text[i] {
+		case '<':
+			end := strings.IndexByte(text[i:], '>')
+			if end < 0 {
+				return cuttable, open
+			}
+			for j := i + 1; j <= i+end; j++ {
+				cuttable[j] = false
+			}
+			tag := text[i : i+end+1]
+			name := htmlTagName(tag)
+			if strings.HasPrefix(tag, "</") {
+				for j := len(open) - 1; j >= 0; j-- {
+					if htmlTagName(open[j]) == name {
+						open = append(append([]string(nil), open[:j]...), open[j+1:]...)
+						break
+					}
+				}
+			} else if !strings.HasSuffix(tag, "/>") {
+				open = append(append([]string(nil), open...), tag)
+			}
+			i += end + 1
+			continue
+		case '&':
+			if end := strings.IndexByte(text[i:], ';'); end > 0 && end <= 10 {
+				for j := i + 1; j <= i+end; j++ {
+					cuttable[j] = false
+				}
+				i += end + 1
+				continue
+			}
+		}
+		i++
+	}
+	return cuttable, open
+}
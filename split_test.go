@@ -0,0 +1,168 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestUTF16Length(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"hello", 5},
+		{"héllo", 5},
+		{"日本語", 3},
+		{"👍", 2},
+	}
+	for _, tt := range tests {
+		if got := utf16Length(tt.in); got != tt.want {
+			t.Errorf("utf16Length(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		parseMode string
+		limit     int
+		want      []string
+	}{
+		{
+			name:  "fits",
+			text:  "short message",
+			limit: 20,
+			want:  []string{"short message"},
+		},
+		{
+			name:  "paragraphs",
+			text:  "first paragraph\n\nsecond paragraph",
+			limit: 20,
+			want:  []string{"first paragraph", "second paragraph"},
+		},
+		{
+			name:  "prefers paragraphs over lines",
+			text:  "line one\nline two\n\nline three",
+			limit: 25,
+			want:  []string{"line one\nline two", "line three"},
+		},
+		{
+			name:  "lines",
+			text:  "line one\nline two\nline three",
+			limit: 12,
+			want:  []string{"line one", "line two", "line three"},
+		},
+		{
+			name:  "words",
+			text:  "alpha beta gamma delta",
+			limit: 11,
+			want:  []string{"alpha beta", "gamma delta"},
+		},
+		{
+			name:  "hard cut",
+			text:  "abcdefghij",
+			limit: 4,
+			want:  []string{"abcd", "efgh", "ij"},
+		},
+		{
+			name:  "does not split surrogate pairs",
+			text:  "👍👍👍",
+			limit: 3,
+			want:  []string{"👍", "👍", "👍"},
+		},
+		{
+			name:      "markdown bold across cut",
+			text:      "*bold words here*",
+			parseMode: tgbotapi.ModeMarkdownV2,
+			limit:     12,
+			want:      []string{"*bold words*", "*here*"},
+		},
+		{
+			name:      "markdown nested entities",
+			text:      "*_one two_*",
+			parseMode: tgbotapi.ModeMarkdownV2,
+			limit:     9,
+			want:      []string{"*_one_*", "*_two_*"},
+		},
+		{
+			name:      "markdown code block reopened with language",
+			text:      "```go\na := 1\nb := 2\n```",
+			parseMode: tgbotapi.ModeMarkdownV2,
+			limit:     20,
+			want:      []string{"```go\na := 1\n```", "```go\nb := 2\n```"},
+		},
+		{
+			name:      "markdown escape is kept together",
+			text:      "abc\\.def",
+			parseMode: tgbotapi.ModeMarkdownV2,
+			limit:     4,
+			want:      []string{"abc", "\\.de", "f"},
+		},
+		{
+			name:      "markdown link is not cut",
+			text:      "see [the docs](https://x.io) now",
+			parseMode: tgbotapi.ModeMarkdownV2,
+			limit:     26,
+			want:      []string{"see", "[the docs](https://x.io)", "now"},
+		},
+		{
+			name:      "markdown spoiler",
+			text:      "||one two||",
+			parseMode: tgbotapi.ModeMarkdownV2,
+			limit:     9,
+			want:      []string{"||one||", "||two||"},
+		},
+		{
+			name:      "html tags reopened",
+			text:      "<b>one <i>two three</i></b>",
+			parseMode: tgbotapi.ModeHTML,
+			limit:     20,
+			want:      []string{"<b>one</b>", "<b><i>two</i></b>", "<b><i>three</i></b>"},
+		},
+		{
+			name:      "html link attributes kept",
+			text:      `<a href="https://x.io">one two</a>`,
+			parseMode: tgbotapi.ModeHTML,
+			limit:     30,
+			want:      []string{`<a href="https://x.io">one</a>`, `<a href="https://x.io">two</a>`},
+		},
+		{
+			name:      "html entity is kept together",
+			text:      "ab&amp;cd",
+			parseMode: tgbotapi.ModeHTML,
+			limit:     5,
+			want:      []string{"ab", "&amp;", "cd"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitMessage(tt.text, tt.parseMode, tt.limit)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitMessage(%q, %d)\n got: %q\nwant: %q", tt.text, tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitMessageRespectsLimit(t *testing.T) {
+	text := markdownToMarkdownV2(strings.Repeat("Some **bold** text with `code` and a [link](https://example.com).\n\n", 200) +
+		"```sh\n" + strings.Repeat("echo line\n", 600) + "```")
+	parts := splitMessage(text, tgbotapi.ModeMarkdownV2, telegramMessageLimit)
+	if len(parts) < 2 {
+		t.Fatalf("expected several parts, got %d", len(parts))
+	}
+	for i, part := range parts {
+		if length := utf16Length(part); length > telegramMessageLimit {
+			t.Errorf("part %d is %d code units long", i, length)
+		}
+		if _, open := scanMarkdownV2(part, nil); len(open) != 0 {
+			t.Errorf("part %d leaves %q open", i, open)
+		}
+	}
+}
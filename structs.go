@@ -1,6 +1,9 @@
 package main
 
-import "html/template"
+import (
+	"html/template"
+	"time"
+)
 
 type Subscription struct {
 	ChatID      int64
@@ -9,6 +12,82 @@ type Subscription struct {
 	UUID        string
 	ReceiveMsgs bool
 	AESKey      string `gorm:"size:32"`
+
+	// RequireSignature rejects requests that are not signed; see
+	// verifySignature. SigningSecret replaces the AES key as HMAC key.
+	RequireSignature bool
+	SigningSecret    string
+
+	// The credentials replaced by the last /regenerate stay valid until
+	// PreviousExpiresAt. GraceOwnerID is reminded before they expire.
+	PreviousUUID          string `gorm:"index"`
+	PreviousAESKey        string `gorm:"size:32"`
+	PreviousSigningSecret string
+	PreviousExpiresAt     *time.Time
+	GraceOwnerID          int64
+	GraceReminded         bool
+
+	// ReplyWebhook receives the replies to notifications sent to the chat.
+	ReplyWebhook string
+
+	// ThreadID is the forum topic notifications go to by default, the one
+	// the chat was subscribed from.
+	ThreadID int
+
+	// QuietHours are daily windows such as "23:00-07:00,12:00-13:00" in
+	// QuietTimezone, UTC if empty. QuietMode says whether notifications are
+	// sent silently during them or held for a digest; see applyQuietHours.
+	QuietHours    string
+	QuietTimezone string
+	QuietMode     string
+
+	// tokenThreadID is the default topic of the API token a request
+	// authenticated with, if it has one.
+	tokenThreadID int
+
+	// usedPreviousCredentials is set for a request that authenticated with
+	// the replaced credentials.
+	usedPreviousCredentials bool
+}
+
+// Token is an additional API token of a subscription. It can be used in
+// place of the subscription's UUID and revoked on its own.
+type Token struct {
+	ID         uint  `gorm:"primaryKey"`
+	ChatID     int64 `gorm:"index"`
+	Label      string
+	Secret     string `gorm:"uniqueIndex"`
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	ExpiresAt  *time.Time
+	RevokedAt  *time.Time
+
+	// ThreadID is the forum topic the token was created in, where its
+	// notifications go by default.
+	ThreadID int
+}
+
+// Topic is a named group of chats that a single request can notify, e.g.
+// everyone on call for an alert source. It is published to with
+// PublishToken; chats join it with /join, with the owner's approval if
+// RequireApproval is set.
+type Topic struct {
+	ID              uint   `gorm:"primaryKey"`
+	Name            string `gorm:"uniqueIndex"`
+	OwnerChatID     int64  `gorm:"index"`
+	PublishToken    string `gorm:"uniqueIndex"`
+	RequireApproval bool
+	CreatedAt       time.Time
+}
+
+// TopicMember is a chat that joined a topic. Members waiting for approval
+// receive nothing.
+type TopicMember struct {
+	ID        uint  `gorm:"primaryKey"`
+	TopicID   uint  `gorm:"uniqueIndex:idx_topic_member"`
+	ChatID    int64 `gorm:"uniqueIndex:idx_topic_member"`
+	Approved  bool
+	CreatedAt time.Time
 }
 
 type Article struct {
@@ -16,17 +95,186 @@ type Article struct {
 	MarkdownText string `json:"markdown_text"`
 }
 
+// Delivery is an outbound notification waiting in (or finished with) the
+// persistent send queue.
+type Delivery struct {
+	ID                uint       `gorm:"primaryKey" json:"-"`
+	UUID              string     `gorm:"uniqueIndex" json:"id"`
+	ChatID            int64      `gorm:"index" json:"chat_id"`
+	Kind              string     `json:"kind"`
+	Format            string     `json:"format,omitempty"`
+	Overflow          string     `json:"overflow,omitempty"`
+	Text              string     `json:"-"`
+	FileName          string     `json:"file_name,omitempty"`
+	MediaType         string     `json:"media_type,omitempty"`
+	FilePath          string     `json:"-"`
+	Status            string     `gorm:"index" json:"status"`
+	Attempts          int        `json:"attempts"`
+	LastError         string     `json:"error,omitempty"`
+	TelegramMessageID int        `json:"message_id,omitempty"`
+	Parts             int        `json:"parts,omitempty"`
+	Buttons           [][]Button `gorm:"serializer:json" json:"buttons,omitempty"`
+	CorrelationKey    string     `json:"correlation_key,omitempty"`
+	ThreadID          int        `json:"thread_id,omitempty"`
+	ReplyToMessageID  int        `json:"reply_to_message_id,omitempty"`
+	Silent            bool       `json:"silent,omitempty"`
+	ProtectContent    bool       `json:"protect_content,omitempty"`
+	DisablePreview    bool       `json:"disable_web_page_preview,omitempty"`
+	Priority          string     `json:"priority,omitempty"`
+	DigestID          string     `json:"digest_id,omitempty"`
+	Topic             string     `json:"topic,omitempty"`
+	PublicationID     string     `gorm:"index" json:"publication_id,omitempty"`
+	SendAt            *time.Time `json:"send_at,omitempty"`
+	NextAttemptAt     time.Time  `json:"next_attempt_at"`
+	SentAt            *time.Time `json:"sent_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+
+	Items     []AlbumItem            `gorm:"foreignKey:DeliveryID" json:"-"`
+	Callbacks []NotificationCallback `gorm:"foreignKey:DeliveryID" json:"-"`
+}
+
+// AlbumItem is one file of an album delivery. The files are sent as a
+// single media group in Position order.
+type AlbumItem struct {
+	ID         uint `gorm:"primaryKey"`
+	DeliveryID uint `gorm:"index"`
+	Position   int
+	FileName   string
+	FilePath   string
+	MediaType  string
+	Caption    string
+}
+
+// SentMessage is a Telegram message sent for a delivery. A long text is
+// split into several messages, numbered by Part.
+type SentMessage struct {
+	ID         uint  `gorm:"primaryKey"`
+	DeliveryID uint  `gorm:"index"`
+	ChatID     int64 `gorm:"index:idx_sent_message"`
+	MessageID  int   `gorm:"index:idx_sent_message"`
+	Part       int
+	CreatedAt  time.Time
+}
+
 type Config struct {
 	TelegramToken  string `toml:"telegram_token"`
 	TelegramAPIURL string `toml:"telegram_api_url"`
 	GinAddress     string `toml:"gin_address"`
 	PostURL        string `toml:"post_url"`
+
+	QueueWorkers     int           `toml:"queue_workers"`
+	QueueMaxAttempts int           `toml:"queue_max_attempts"`
+	QueueRetryBase   time.Duration `toml:"queue_retry_base"`
+	QueueRetryMax    time.Duration `toml:"queue_retry_max"`
+
+	SignatureWindow time.Duration `toml:"signature_window"`
+
+	RegenerateGrace    time.Duration `toml:"regenerate_grace"`
+	RegenerateReminder time.Duration `toml:"regenerate_reminder"`
+
+	FetchAllowedHosts []string      `toml:"fetch_allowed_hosts"`
+	FetchMaxSize      int64         `toml:"fetch_max_size"`
+	FetchTimeout      time.Duration `toml:"fetch_timeout"`
+	LocalFileDirs     []string      `toml:"local_file_dirs"`
+
+	WebhookAllowedHosts []string      `toml:"webhook_allowed_hosts"`
+	WebhookTimeout      time.Duration `toml:"webhook_timeout"`
+
+	IdempotencyWindow time.Duration `toml:"idempotency_window"`
 }
 
 type Message struct {
 	Encrypted bool   `json:"encrypted" default:"false" form:"encrypted"`
+	Cipher    string `json:"cipher" default:"cbc" form:"cipher"`
 	Format    string `json:"format" default:"markdown" form:"format"`
 	Msg       string `json:"msg" default:"Hello" form:"msg"`
+	Overflow  string `json:"overflow" default:"split" form:"overflow"`
+
+	Buttons [][]Button `json:"buttons" form:"-"`
+	Webhook string     `json:"webhook" form:"-"`
+
+	CorrelationKey string `json:"correlation_key" form:"correlation_key"`
+
+	ThreadID         int `json:"thread_id" form:"thread_id"`
+	ReplyToMessageID int `json:"reply_to_message_id" form:"reply_to_message_id"`
+
+	// Silent messages arrive without a sound, protected ones cannot be
+	// forwarded or saved, and DisablePreview hides link previews.
+	Silent         bool `json:"silent" form:"silent"`
+	ProtectContent bool `json:"protect_content" form:"protect_content"`
+	DisablePreview bool `json:"disable_web_page_preview" form:"disable_web_page_preview"`
+
+	// Priority high sends the message during quiet hours as usual.
+	Priority string `json:"priority" form:"priority"`
+
+	// SendAt, an RFC 3339 time, or Delay, a duration such as 10m, schedule
+	// the message for later.
+	SendAt string `json:"send_at" form:"send_at"`
+	Delay  string `json:"delay" form:"delay"`
+
+	// DedupKey works like the Idempotency-Key header: the message is only
+	// sent once per key within the idempotency window.
+	DedupKey string `json:"dedup_key" form:"dedup_key"`
+
+	// Messages with the same GroupKey within GroupWindow, a duration such
+	// as 5m, are counted in the first one instead of being sent again.
+	GroupKey    string `json:"group_key" form:"group_key"`
+	GroupWindow string `json:"group_window" form:"group_window"`
+}
+
+// AlertGroup counts the repeats of the message with a group key whose window
+// is open. It is removed once the window closes.
+type AlertGroup struct {
+	ID     uint   `gorm:"primaryKey"`
+	ChatID int64  `gorm:"index:idx_alert_group"`
+	Key    string `gorm:"index:idx_alert_group"`
+	// DeliveryID is the first message, which shows the count.
+	DeliveryID uint
+	Count      int
+	// ShownCount is the count the first message was last edited to show.
+	ShownCount int
+	FirstAt    time.Time
+	LastAt     time.Time
+	ClosesAt   time.Time `gorm:"index"`
+}
+
+// IdempotencyKey remembers the delivery queued by a request with an
+// idempotency key, so that a retry of the request is answered with it
+// instead of sending the message again.
+type IdempotencyKey struct {
+	ID     uint   `gorm:"primaryKey"`
+	ChatID int64  `gorm:"uniqueIndex:idx_idempotency_key"`
+	Key    string `gorm:"uniqueIndex:idx_idempotency_key"`
+	// DeliveryID is empty while the first request is in progress.
+	DeliveryID string
+	CreatedAt  time.Time `gorm:"index"`
+}
+
+// Button is an inline keyboard button of a notification. It opens URL or,
+// when pressed, sends CallbackData back to the bot.
+type Button struct {
+	Text         string `json:"text"`
+	URL          string `json:"url,omitempty"`
+	CallbackData string `json:"callback_data,omitempty"`
+
+	// CallbackID names the NotificationCallback that stores the callback
+	// data of a message sent with a webhook.
+	CallbackID string `json:"callback_id,omitempty"`
+}
+
+// NotificationCallback is a callback button of a notification whose press
+// is posted to Webhook. Telegram only sees its opaque ShortID.
+type NotificationCallback struct {
+	ID         uint   `gorm:"primaryKey"`
+	ShortID    string `gorm:"uniqueIndex"`
+	DeliveryID uint   `gorm:"index"`
+	ChatID     int64
+	Text       string
+	Data       string
+	Webhook    string
+	AnsweredAt *time.Time
+	CreatedAt  time.Time
 }
 
 type KeyboardCallbackData struct {
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+// The Telegram bot API library predates forum topics, so notifications are
+// sent with requests built here, and the topic of incoming messages is read
+// from the raw updates.
+
+// sendOptions place a delivery within its chat and say how it is shown.
+type sendOptions struct {
+	threadID         int
+	replyToMessageID int
+	silent           bool
+	protectContent   bool
+	disablePreview   bool
+}
+
+func deliveryOptions(delivery *Delivery) sendOptions {
+	return sendOptions{
+		threadID:         delivery.ThreadID,
+		replyToMessageID: delivery.ReplyToMessageID,
+		silent:           delivery.Silent,
+		protectContent:   delivery.ProtectContent,
+		disablePreview:   delivery.DisablePreview,
+	}
+}
+
+// followUp are the options of the messages that continue a delivery, e.g.
+// the later parts of a split message: same topic, but no reply.
+func (o sendOptions) followUp() sendOptions {
+	o.replyToMessageID = 0
+	return o
+}
+
+func (o sendOptions) params(chatID int64) tgbotapi.Params {
+	params := make(tgbotapi.Params)
+	params.AddNonZero64("chat_id", chatID)
+	params.AddNonZero("message_thread_id", o.threadID)
+	if o.replyToMessageID != 0 {
+		params.AddNonZero("reply_to_message_id", o.replyToMessageID)
+		// A reply to a message deleted in the meantime is still delivered.
+		params.AddBool("allow_sending_without_reply", true)
+	}
+	params.AddBool("disable_notification", o.silent)
+	params.AddBool("protect_content", o.protectContent)
+	return params
+}
+
+// callAPI is send for requests built with sendOptions.
+func callAPI(chatID int64, endpoint string, params tgbotapi.Params, files []tgbotapi.RequestFile, result interface{}) error {
+	limiter.wait(chatID)
+	var resp *tgbotapi.APIResponse
+	var err error
+	if len(files) > 0 {
+		resp, err = bot.UploadFiles(endpoint, params, files)
+	} else {
+		resp, err = bot.MakeRequest(endpoint, params)
+	}
+	if wait := retryAfter(err); wait > 0 {
+		limiter.pause(chatID, wait)
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// sendMessage sends text in parseMode with keyboard, if any, attached.
+func sendMessage(chatID int64, text string, parseMode string, keyboard *tgbotapi.InlineKeyboardMarkup, options sendOptions) (tgbotapi.Message, error) {
+	params := options.params(chatID)
+	params["text"] = text
+	params.AddNonEmpty("parse_mode", parseMode)
+	params.AddBool("disable_web_page_preview", options.disablePreview)
+	if err := params.AddInterface("reply_markup", keyboard); err != nil {
+		return tgbotapi.Message{}, err
+	}
+	var sent tgbotapi.Message
+	err := callAPI(chatID, "sendMessage", params, nil, &sent)
+	return sent, err
+}
+
+// mediaMethod names the method that sends a file as mediaType and the field
+// the file is uploaded in.
+func mediaMethod(mediaType string) (string, string) {
+	switch mediaType {
+	case mediaPhoto, mediaVideo, mediaAudio, mediaVoice, mediaAnimation:
+		return "send" + capitalize(mediaType), mediaType
+	default:
+		return "sendDocument", mediaDocument
+	}
+}
+
+// uploadFile uploads the file at path as mediaType with caption attached.
+func uploadFile(chatID int64, path string, name string, mediaType string, caption string, options sendOptions) (tgbotapi.Message, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		logger.Error("Failed to open file: "+path, zap.Error(err))
+		return tgbotapi.Message{}, err
+	}
+	defer file.Close()
+	method, field := mediaMethod(mediaType)
+	params := options.params(chatID)
+	params.AddNonEmpty("caption", caption)
+	if mediaType == mediaVideo {
+		params.AddBool("supports_streaming", true)
+	}
+	var sent tgbotapi.Message
+	err = callAPI(chatID, method, params, []tgbotapi.RequestFile{{Name: field, Data: tgbotapi.FileReader{Name: name, Reader: file}}}, &sent)
+	return sent, err
+}
+
+// sendAlbum uploads the spooled files of an album as one media group.
+func sendAlbum(chatID int64, items []AlbumItem, options sendOptions) ([]tgbotapi.Message, error) {
+	media := make([]interface{}, len(items))
+	files := make([]tgbotapi.RequestFile, len(items))
+	for i, item := range items {
+		file, err := os.Open(item.FilePath)
+		if err != nil {
+			logger.Error("Failed to open file: "+item.FilePath, zap.Error(err))
+			return nil, err
+		}
+		defer file.Close()
+		attach := fmt.Sprintf("file-%d", i)
+		media[i] = newInputMedia(item.MediaType, tgbotapi.FileURL("attach://"+attach), item.Caption)
+		files[i] = tgbotapi.RequestFile{Name: attach, Data: tgbotapi.FileReader{Name: item.FileName, Reader: file}}
+	}
+	logger.Debug("Sending album", zap.Int("files", len(items)))
+	params := options.params(chatID)
+	if err := params.AddInterface("media", media); err != nil {
+		return nil, err
+	}
+	var sent []tgbotapi.Message
+	err := callAPI(chatID, "sendMediaGroup", params, files, &sent)
+	return sent, err
+}
+
+// topicMessage holds the fields of a message about forum topics.
+type topicMessage struct {
+	MessageThreadID int  `json:"message_thread_id"`
+	IsTopicMessage  bool `json:"is_topic_message"`
+}
+
+// threadID returns the forum topic a message was sent in, 0 outside of
+// topics.
+func (m *topicMessage) threadID() int {
+	if m == nil || !m.IsTopicMessage {
+		return 0
+	}
+	return m.MessageThreadID
+}
+
+// decodeUpdates decodes a getUpdates result together with the topic of
+// each update's message.
+func decodeUpdates(result json.RawMessage) ([]tgbotapi.Update, []int, error) {
+	var updates []tgbotapi.Update
+	if err := json.Unmarshal(result, &updates); err != nil {
+		return nil, nil, err
+	}
+	var topics []struct {
+		Message *topicMessage `json:"message"`
+	}
+	if err := json.Unmarshal(result, &topics); err != nil {
+		return nil, nil, err
+	}
+	threadIDs := make([]int, len(updates))
+	for i := range updates {
+		threadIDs[i] = topics[i].Message.threadID()
+	}
+	return updates, threadIDs, nil
+}
+
+// receiveUpdates long-polls Telegram for updates and processes them one at
+// a time, like the update channel of the library does.
+func receiveUpdates() {
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+	for {
+		resp, err := bot.Request(u)
+		if err != nil {
+			logger.Error("Failed to get updates, retrying in 3 seconds", zap.Error(err))
+			time.Sleep(3 * time.Second)
+			continue
+		}
+		updates, threadIDs, err := decodeUpdates(resp.Result)
+		if err != nil {
+			logger.Error("Failed to decode updates", zap.Error(err))
+			time.Sleep(3 * time.Second)
+			continue
+		}
+		for i, update := range updates {
+			if update.UpdateID >= u.Offset {
+				u.Offset = update.UpdateID + 1
+			}
+			processUpdate(update, threadIDs[i])
+		}
+	}
+}
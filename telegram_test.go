@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestDecodeUpdatesReadsTopic(t *testing.T) {
+	result := []byte(`[
+		{"update_id": 1, "message": {"message_id": 10, "message_thread_id": 5, "is_topic_message": true, "chat": {"id": -100}, "text": "/subscribe"}},
+		{"update_id": 2, "message": {"message_id": 11, "message_thread_id": 10, "chat": {"id": -100}, "text": "reply outside topics"}},
+		{"update_id": 3, "callback_query": {"id": "q", "data": "n:x"}}
+	]`)
+	updates, threadIDs, err := decodeUpdates(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 3 || updates[0].Message.Text != "/subscribe" || updates[2].CallbackQuery == nil {
+		t.Fatalf("decodeUpdates() = %+v", updates)
+	}
+	if threadIDs[0] != 5 || threadIDs[1] != 0 || threadIDs[2] != 0 {
+		t.Errorf("thread IDs = %v, want [5 0 0]", threadIDs)
+	}
+}
+
+func TestSendMessageInTopic(t *testing.T) {
+	form := fakeTelegram(t, `{"message_id": 42, "chat": {"id": -1001}}`)
+	keyboard := inlineKeyboard([][]Button{{{Text: "Open", URL: "https://example.org"}}})
+	sent, err := sendMessage(-1001, "*Disk full*", tgbotapi.ModeMarkdownV2, keyboard, sendOptions{threadID: 5, replyToMessageID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.MessageID != 42 {
+		t.Errorf("message ID = %d, want 42", sent.MessageID)
+	}
+	for key, want := range map[string]string{
+		"chat_id":                     "-1001",
+		"text":                        "*Disk full*",
+		"parse_mode":                  tgbotapi.ModeMarkdownV2,
+		"message_thread_id":           "5",
+		"reply_to_message_id":         "7",
+		"allow_sending_without_reply": "true",
+	} {
+		if got := form.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if form.Get("reply_markup") == "" {
+		t.Error("keyboard not sent")
+	}
+
+	if _, err := sendMessage(-1002, "part 2", "", nil, sendOptions{threadID: 5, replyToMessageID: 7}.followUp()); err != nil {
+		t.Fatal(err)
+	}
+	if form.Get("message_thread_id") != "5" || form.Has("reply_to_message_id") || form.Has("reply_markup") {
+		t.Errorf("follow-up sent with %v", *form)
+	}
+}
+
+func TestResolveThread(t *testing.T) {
+	subscription := &Subscription{ThreadID: 3}
+	if threadID, _ := resolveThread(subscription, 0, 0); threadID != 3 {
+		t.Errorf("default topic = %d, want 3", threadID)
+	}
+	subscription.tokenThreadID = 4
+	if threadID, _ := resolveThread(subscription, 0, 0); threadID != 4 {
+		t.Errorf("token topic = %d, want 4", threadID)
+	}
+	if threadID, _ := resolveThread(subscription, 9, 0); threadID != 9 {
+		t.Errorf("requested topic = %d, want 9", threadID)
+	}
+	if _, err := resolveThread(subscription, 0, -1); err == nil {
+		t.Error("accepted a negative reply_to_message_id")
+	}
+}
+
+func TestSendAlbumAttachesFiles(t *testing.T) {
+	form := fakeTelegram(t, `[{"message_id": 1}, {"message_id": 2}]`)
+	dir := t.TempDir()
+	items := []AlbumItem{
+		{FilePath: writeTestFile(t, dir, "a.jpg"), FileName: "a.jpg", MediaType: mediaPhoto, Caption: "first"},
+		{FilePath: writeTestFile(t, dir, "b.mp4"), FileName: "b.mp4", MediaType: mediaVideo},
+	}
+	sent, err := sendAlbum(-1003, items, sendOptions{threadID: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 {
+		t.Errorf("sent %d messages, want 2", len(sent))
+	}
+	var media []struct {
+		Type    string `json:"type"`
+		Media   string `json:"media"`
+		Caption string `json:"caption"`
+	}
+	if err := json.Unmarshal([]byte(form.Get("media")), &media); err != nil {
+		t.Fatal(err)
+	}
+	if len(media) != 2 || media[0].Media != "attach://file-0" || media[0].Caption != "first" || media[1].Type != mediaVideo || media[1].Media != "attach://file-1" {
+		t.Errorf("media = %s", form.Get("media"))
+	}
+	if form.Get("message_thread_id") != "5" {
+		t.Errorf("message_thread_id = %q", form.Get("message_thread_id"))
+	}
+}
+
+func writeTestFile(t *testing.T, dir string, name string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(name), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSendMessageOptions(t *testing.T) {
+	form := fakeTelegram(t, `{"message_id": 43}`)
+	if _, err := sendMessage(-1004, config.PostURL+"/html/x", "", nil, sendOptions{silent: true, protectContent: true, disablePreview: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"disable_notification", "protect_content", "disable_web_page_preview"} {
+		if form.Get(key) != "true" {
+			t.Errorf("%s = %q, want true", key, form.Get(key))
+		}
+	}
+	if _, err := sendMessage(-1005, "loud", "", nil, sendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if form.Has("disable_notification") || form.Has("protect_content") || form.Has("disable_web_page_preview") {
+		t.Errorf("options sent by default: %v", *form)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newToken creates an API token for chatID that expires after validFor, or
+// never if validFor is zero. Its notifications go to the forum topic
+// threadID unless the request names another one.
+func newToken(chatID int64, label string, validFor time.Duration, threadID int) (*Token, error) {
+	token := Token{
+		ChatID:   chatID,
+		Label:    label,
+		Secret:   strings.Replace(uuid.New().String(), "-", "", -1),
+		ThreadID: threadID,
+	}
+	if validFor > 0 {
+		expiresAt := time.Now().Add(validFor)
+		token.ExpiresAt = &expiresAt
+	}
+	if err := db.Create(&token).Error; err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// lookupToken returns an active token and records that it was
+// used.
+func lookupToken(secret string) (*Token, bool) {
+	var token Token
+	now := time.Now()
+	err := db.Where("secret = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", secret, now).First(&token).Error
+	if err != nil {
+		return nil, false
+	}
+	db.Model(&token).Update("last_used_at", now)
+	return &token, true
+}
+
+// revokeToken revokes the token with the given ID if it belongs to chatID.
+func revokeToken(chatID int64, id uint) error {
+	result := db.Model(&Token{}).Where("id = ? AND chat_id = ? AND revoked_at IS NULL", id, chatID).Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no active token with ID %d", id)
+	}
+	return nil
+}
+
+// parseTokenExpiry parses the validity of a token: a Go duration such as
+// "12h" or a number of days such as "30d".
+func parseTokenExpiry(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid number of days: %s", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+	return d, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLookupToken(t *testing.T) {
+	openTestDB(t)
+	active, err := newToken(1, "cron-1", 0, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, _ := newToken(1, "cron-2", 0, 0)
+	expired, _ := newToken(2, "ci", time.Hour, 0)
+	db.Model(expired).Update("expires_at", time.Now().Add(-time.Minute))
+	if err := revokeToken(1, revoked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if token, ok := lookupToken(active.Secret); !ok || token.ChatID != 1 || token.ThreadID != 7 {
+		t.Errorf("lookupToken(active) = %+v, %v, want chat 1 and topic 7", token, ok)
+	}
+	var used Token
+	db.First(&used, active.ID)
+	if used.LastUsedAt == nil {
+		t.Error("last_used_at not recorded")
+	}
+	if _, ok := lookupToken(revoked.Secret); ok {
+		t.Error("revoked token accepted")
+	}
+	if _, ok := lookupToken(expired.Secret); ok {
+		t.Error("expired token accepted")
+	}
+	if _, ok := lookupToken("unknown"); ok {
+		t.Error("unknown token accepted")
+	}
+}
+
+func TestRevokeTokenOfOtherChat(t *testing.T) {
+	openTestDB(t)
+	token, err := newToken(1, "cron", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := revokeToken(2, token.ID); err == nil {
+		t.Error("revoked a token of another chat")
+	}
+	if err := revokeToken(1, token.ID); err != nil {
+		t.Errorf("revokeToken() = %v", err)
+	}
+	if err := revokeToken(1, token.ID); err == nil {
+		t.Error("revoked a token twice")
+	}
+}
+
+func TestParseTokenExpiry(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"30d", 30 * 24 * time.Hour, false},
+		{"12h", 12 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"0d", 0, true},
+		{"-1h", 0, true},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTokenExpiry(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseTokenExpiry(%q) = %v, %v, want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var topicNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+var errInvalidTopic = &authorizationError{http.StatusNotFound, "Invalid topic or publish token"}
+
+// TopicRecipient reports the delivery of a topic message to one member.
+type TopicRecipient struct {
+	ChatID     int64  `json:"chat_id"`
+	Name       string `json:"name,omitempty"`
+	DeliveryID string `json:"delivery_id,omitempty"`
+	Status     string `json:"status"`
+	MessageID  int    `json:"message_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// newTopic creates a topic owned by chatID with a new publish token.
+func newTopic(name string, ownerChatID int64, requireApproval bool) (*Topic, error) {
+	if !topicNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid topic name %q, use up to 64 lowercase letters, digits, - and _", name)
+	}
+	var existing int64
+	db.Model(&Topic{}).Where("name = ?", name).Count(&existing)
+	if existing > 0 {
+		return nil, fmt.Errorf("topic %s already exists", name)
+	}
+	topic := Topic{
+		Name:            name,
+		OwnerChatID:     ownerChatID,
+		PublishToken:    newPublishToken(),
+		RequireApproval: requireApproval,
+	}
+	if err := db.Create(&topic).Error; err != nil {
+		return nil, err
+	}
+	return &topic, nil
+}
+
+// newPublishToken returns a random publish token.
+func newPublishToken() string {
+	return strings.Replace(uuid.New().String(), "-", "", -1)
+}
+
+// regenerateTopicToken replaces the publish token of the topic name owned by
+// ownerChatID. The old token stops working at once.
+func regenerateTopicToken(ownerChatID int64, name string) (*Topic, error) {
+	var topic Topic
+	if err := db.Where("name = ? AND owner_chat_id = ?", name, ownerChatID).First(&topic).Error; err != nil {
+		return nil, fmt.Errorf("you do not own a topic %s", name)
+	}
+	topic.PublishToken = newPublishToken()
+	if err := db.Model(&Topic{}).Where("id = ?", topic.ID).Update("publish_token", topic.PublishToken).Error; err != nil {
+		return nil, err
+	}
+	return &topic, nil
+}
+
+// deleteTopic removes the topic name owned by ownerChatID and its members.
+func deleteTopic(ownerChatID int64, name string) error {
+	var topic Topic
+	if err := db.Where("name = ? AND owner_chat_id = ?", name, ownerChatID).First(&topic).Error; err != nil {
+		return fmt.Errorf("you do not own a topic %s", name)
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("topic_id = ?", topic.ID).Delete(&TopicMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&topic).Error
+	})
+}
+
+// joinTopic adds chatID to topic, approved unless the topic requires the
+// owner's approval. Joining again keeps the current state.
+func joinTopic(topic *Topic, chatID int64) (*TopicMember, error) {
+	member := TopicMember{TopicID: topic.ID, ChatID: chatID, Approved: !topic.RequireApproval || chatID == topic.OwnerChatID}
+	err := db.Where(TopicMember{TopicID: topic.ID, ChatID: chatID}).Attrs(TopicMember{Approved: member.Approved}).FirstOrCreate(&member).Error
+	return &member, err
+}
+
+// topicRecipients returns the approved members of topic.
+func topicRecipients(topic *Topic) ([]TopicMember, error) {
+	var members []TopicMember
+	err := db.Where("topic_id = ? AND approved = ?", topic.ID, true).Order("id").Find(&members).Error
+	return members, err
+}
+
+// checkTopicAuthorization looks up the topic named in the URL and checks the
+// publish token, sent as a bearer token or in the token query parameter.
+func checkTopicAuthorization(c *gin.Context) (*Topic, error) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		token = c.Query("token")
+	}
+	var topic Topic
+	if err := db.Where("name = ?", c.Param("topic")).First(&topic).Error; err != nil {
+		return nil, errInvalidTopic
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(topic.PublishToken)) != 1 {
+		return nil, errInvalidTopic
+	}
+	return &topic, nil
+}
+
+// queueTopicMessage queues msg for every approved member of topic that is
+// subscribed. Every message sent to the topic shares a publication ID.
+func queueTopicMessage(topic *Topic, msg *Message) (string, []TopicRecipient, error) {
+	members, err := topicRecipients(topic)
+	if err != nil {
+		return "", nil, err
+	}
+	publicationID := strings.Replace(uuid.New().String(), "-", "", -1)
+	recipients := make([]TopicRecipient, 0, len(members))
+	for _, member := range members {
+		recipient := TopicRecipient{ChatID: member.ChatID}
+		var subscription Subscription
+		db.First(&subscription, "chat_id = ?", member.ChatID)
+		recipient.Name = subscriptionName(&subscription)
+		if subscription.UUID == "" || !subscription.ReceiveMsgs {
+			recipient.Status = deliveryFailed
+			recipient.Error = "not subscribed"
+			recipients = append(recipients, recipient)
+			continue
+		}
+		delivery, err := newTextDelivery(member.ChatID, msg, msg.Msg, subscription.ThreadID)
+		if err == nil {
+			delivery.Topic = topic.Name
+			delivery.PublicationID = publicationID
+			err = enqueueDelivery(&delivery)
+		}
+		if err != nil {
+			logger.Error("Failed to queue topic message", zap.String("topic", topic.Name), zap.Int64("chatID", member.ChatID), zap.Error(err))
+			recipient.Status = deliveryFailed
+			recipient.Error = "failed to queue message"
+		} else {
+			recipient.DeliveryID = delivery.UUID
+			recipient.Status = delivery.Status
+		}
+		recipients = append(recipients, recipient)
+	}
+	return publicationID, recipients, nil
+}
+
+// subscriptionName is how a member is named in reports: by username or
+// nickname.
+func subscriptionName(subscription *Subscription) string {
+	if subscription.UserName != "" {
+		return "@" + subscription.UserName
+	}
+	return strings.TrimSpace(subscription.NickName)
+}
+
+// refreshRecipients updates the report of a publication with the current
+// state of its deliveries.
+func refreshRecipients(recipients []TopicRecipient) {
+	for i := range recipients {
+		if recipients[i].DeliveryID == "" {
+			continue
+		}
+		var delivery Delivery
+		if db.Where("uuid = ?", recipients[i].DeliveryID).First(&delivery).Error == nil {
+			recipients[i].Status = delivery.Status
+			recipients[i].MessageID = delivery.TelegramMessageID
+			recipients[i].Error = delivery.LastError
+		}
+	}
+}
+
+// waitForRecipients waits, within a single timeout, for the deliveries of a
+// publication to be sent or to fail.
+func waitForRecipients(recipients []TopicRecipient, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, recipient := range recipients {
+		if recipient.DeliveryID == "" {
+			continue
+		}
+		var delivery Delivery
+		if db.Where("uuid = ?", recipient.DeliveryID).First(&delivery).Error == nil {
+			waitForDelivery(delivery.ID, time.Until(deadline))
+		}
+	}
+	refreshRecipients(recipients)
+}
+
+func handleTopicJSON(c *gin.Context) {
+	realIP := getRealIP(c)
+	topic, err := checkTopicAuthorization(c)
+	if err != nil {
+		respondAuthorizationError(c, realIP, err)
+		return
+	}
+	var msg Message
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		logger.Error("Invalid JSON from "+realIP, zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Invalid JSON",
+		})
+		return
+	}
+	if err := checkMessage(&msg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	// Members have keys of their own and topics of their own chats.
+	if msg.Encrypted || msg.ThreadID != 0 || msg.ReplyToMessageID != 0 || msg.GroupKey != "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Topic messages cannot be encrypted, sent to a thread or as a reply, or grouped",
+		})
+		return
+	}
+	// Retries of a topic message are not recognised, so keys are refused
+	// rather than silently ignored.
+	if c.GetHeader("Idempotency-Key") != "" || msg.DedupKey != "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "Topic messages do not support the Idempotency-Key header or dedup_key",
+		})
+		return
+	}
+	publicationID, recipients, err := queueTopicMessage(topic, &msg)
+	if err != nil {
+		logger.Error("Failed to queue topic message from "+realIP, zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Failed to queue message",
+		})
+		return
+	}
+	if wait, _ := strconv.ParseBool(c.Query("wait")); wait {
+		waitForRecipients(recipients, deliveryWaitTimeout)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":        fmt.Sprintf("Message queued for %d of %d members", countQueued(recipients), len(recipients)),
+		"topic":          topic.Name,
+		"publication_id": publicationID,
+		"recipients":     recipients,
+	})
+}
+
+func countQueued(recipients []TopicRecipient) int {
+	queued := 0
+	for _, recipient := range recipients {
+		if recipient.DeliveryID != "" {
+			queued++
+		}
+	}
+	return queued
+}
+
+// handleTopicPublication reports the deliveries of a message sent to a
+// topic.
+func handleTopicPublication(c *gin.Context) {
+	realIP := getRealIP(c)
+	topic, err := checkTopicAuthorization(c)
+	if err != nil {
+		respondAuthorizationError(c, realIP, err)
+		return
+	}
+	var deliveries []Delivery
+	db.Where("publication_id = ? AND topic = ?", c.Param("id"), topic.Name).Order("id").Find(&deliveries)
+	if len(deliveries) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "Message not found",
+		})
+		return
+	}
+	recipients := make([]TopicRecipient, len(deliveries))
+	for i, delivery := range deliveries {
+		var subscription Subscription
+		db.First(&subscription, "chat_id = ?", delivery.ChatID)
+		recipients[i] = TopicRecipient{ChatID: delivery.ChatID, Name: subscriptionName(&subscription), DeliveryID: delivery.UUID}
+	}
+	refreshRecipients(recipients)
+	c.JSON(http.StatusOK, gin.H{
+		"topic":          topic.Name,
+		"publication_id": c.Param("id"),
+		"recipients":     recipients,
+	})
+}
+
+// handleTopicNew creates a topic owned by chatID: /topic_new <name> [approval].
+func handleTopicNew(chatID int64, managerID int64, args []string) {
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && strings.ToLower(args[1]) != "approval") {
+		bot.Send(tgbotapi.NewMessage(managerID, "Usage: /topic_new <name> [approval]"))
+		return
+	}
+	topic, err := newTopic(strings.ToLower(args[0]), chatID, len(args) == 2)
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(managerID, "Failed to create topic: "+err.Error()))
+		return
+	}
+	msgText := "Created topic `" + topic.Name + "`\n\n"
+	msgText += "Publish token: `" + topic.PublishToken + "`\n\n"
+	if topic.RequireApproval {
+		msgText += "Chats join with `/join " + topic.Name + "` once you approve them\n\n"
+	} else {
+		msgText += "Chats join with `/join " + topic.Name + "`\n\n"
+	}
+	msgText += "Send to all members with `POST " + config.PostURL + "/api/topic/" + topic.Name + "/json` and the header `Authorization: Bearer <publish token>`"
+	sendMarkdownV2(managerID, msgText)
+}
+
+// handleTopicToken replaces the publish token of a topic owned by chatID:
+// /topic_token <name>.
+func handleTopicToken(chatID int64, managerID int64, args []string) {
+	if len(args) != 1 {
+		bot.Send(tgbotapi.NewMessage(managerID, "Usage: /topic_token <name>"))
+		return
+	}
+	topic, err := regenerateTopicToken(chatID, strings.ToLower(args[0]))
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(managerID, "Failed to regenerate publish token: "+err.Error()))
+		return
+	}
+	sendMarkdownV2(managerID, "New publish token of topic `"+topic.Name+"`: `"+topic.PublishToken+"`\n\nThe old token no longer works")
+}
+
+// handleTopicDelete removes a topic owned by chatID: /topic_delete <name>.
+func handleTopicDelete(chatID int64, managerID int64, args []string) {
+	if len(args) != 1 {
+		bot.Send(tgbotapi.NewMessage(managerID, "Usage: /topic_delete <name>"))
+		return
+	}
+	name := strings.ToLower(args[0])
+	if err := deleteTopic(chatID, name); err != nil {
+		bot.Send(tgbotapi.NewMessage(managerID, "Failed to delete topic: "+err.Error()))
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(managerID, "Deleted topic "+name))
+}
+
+// handleJoin adds chatID to a topic, or asks the topic's owner to approve it.
+func handleJoin(chatID int64, managerID int64, args []string) {
+	if len(args) != 1 {
+		bot.Send(tgbotapi.NewMessage(managerID, "Usage: /join <topic>"))
+		return
+	}
+	var subscription Subscription
+	db.First(&subscription, "chat_id = ?", chatID)
+	if subscription.UUID == "" {
+		bot.Send(tgbotapi.NewMessage(managerID, "Subscribe first with /subscribe"))
+		return
+	}
+	var topic Topic
+	if err := db.Where("name = ?", strings.ToLower(args[0])).First(&topic).Error; err != nil {
+		bot.Send(tgbotapi.NewMessage(managerID, "No topic "+args[0]))
+		return
+	}
+	member, err := joinTopic(&topic, chatID)
+	if err != nil {
+		logger.Error("Failed to join topic", zap.Error(err))
+		bot.Send(tgbotapi.NewMessage(managerID, "Failed to join topic"))
+		return
+	}
+	if member.Approved {
+		bot.Send(tgbotapi.NewMessage(managerID, "Joined topic "+topic.Name))
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(managerID, "Asked the owner of topic "+topic.Name+" to approve this chat"))
+	chat := strconv.FormatInt(chatID, 10)
+	request := "Chat " + chat
+	if name := subscriptionName(&subscription); name != "" {
+		request += " (" + name + ")"
+	}
+	request += " wants to join topic " + topic.Name + ".\n\n/approve " + topic.Name + " " + chat + "\n/reject " + topic.Name + " " + chat
+	if _, err := sendText(topic.OwnerChatID, request); err != nil {
+		logger.Error("Failed to ask for topic approval", zap.String("topic", topic.Name), zap.Error(err))
+	}
+}
+
+// handleLeave removes chatID from a topic.
+func handleLeave(chatID int64, managerID int64, args []string) {
+	if len(args) != 1 {
+		bot.Send(tgbotapi.NewMessage(managerID, "Usage: /leave <topic>"))
+		return
+	}
+	result := db.Where("chat_id = ? AND topic_id IN (?)", chatID, db.Model(&Topic{}).Select("id").Where("name = ?", strings.ToLower(args[0]))).Delete(&TopicMember{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		bot.Send(tgbotapi.NewMessage(managerID, "Not a member of topic "+args[0]))
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(managerID, "Left topic "+strings.ToLower(args[0])))
+}
+
+// handleTopicMember approves, or with approve false rejects or removes, a
+// member of a topic owned by chatID: /approve|/reject <topic> <chat ID>.
+func handleTopicMember(chatID int64, managerID int64, args []string, approve bool) {
+	command := "/reject"
+	if approve {
+		command = "/approve"
+	}
+	if len(args) != 2 {
+		bot.Send(tgbotapi.NewMessage(managerID, "Usage: "+command+" <topic> <chat ID>"))
+		return
+	}
+	memberChatID, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(managerID, "Usage: "+command+" <topic> <chat ID>"))
+		return
+	}
+	var topic Topic
+	if err := db.Where("name = ? AND owner_chat_id = ?", strings.ToLower(args[0]), chatID).First(&topic).Error; err != nil {
+		bot.Send(tgbotapi.NewMessage(managerID, "You do not own a topic "+args[0]))
+		return
+	}
+	query := db.Where("topic_id = ? AND chat_id = ?", topic.ID, memberChatID)
+	var result int64
+	if approve {
+		result = query.Model(&TopicMember{}).Update("approved", true).RowsAffected
+	} else {
+		result = query.Delete(&TopicMember{}).RowsAffected
+	}
+	if result == 0 {
+		bot.Send(tgbotapi.NewMessage(managerID, "Chat "+args[1]+" has not asked to join topic "+topic.Name))
+		return
+	}
+	if approve {
+		bot.Send(tgbotapi.NewMessage(managerID, "Chat "+args[1]+" joined topic "+topic.Name))
+		sendText(memberChatID, "You joined topic "+topic.Name)
+	} else {
+		bot.Send(tgbotapi.NewMessage(managerID, "Chat "+args[1]+" is not a member of topic "+topic.Name))
+	}
+}
+
+// handleTopics lists the topics chatID owns, with their members, and the
+// ones it joined.
+func handleTopics(chatID int64, managerID int64) {
+	var owned []Topic
+	db.Where("owner_chat_id = ?", chatID).Order("name").Find(&owned)
+	var joined []Topic
+	db.Where("id IN (?) AND owner_chat_id <> ?", db.Model(&TopicMember{}).Select("topic_id").Where("chat_id = ? AND approved = ?", chatID, true), chatID).Order("name").Find(&joined)
+	if len(owned) == 0 && len(joined) == 0 {
+		bot.Send(tgbotapi.NewMessage(managerID, "No topics, use /topic_new <name> to create one or /join <topic> to join one"))
+		return
+	}
+	msgText := ""
+	for _, topic := range owned {
+		var members []TopicMember
+		db.Where("topic_id = ?", topic.ID).Order("id").Find(&members)
+		msgText += "Topic " + topic.Name + " (owned, token " + topic.PublishToken[:6] + "…):\n"
+		for _, member := range members {
+			var subscription Subscription
+			db.First(&subscription, "chat_id = ?", member.ChatID)
+			msgText += "  " + strconv.FormatInt(member.ChatID, 10)
+			if name := subscriptionName(&subscription); name != "" {
+				msgText += " " + name
+			}
+			if !member.Approved {
+				msgText += " (waiting for approval)"
+			}
+			msgText += "\n"
+		}
+	}
+	for _, topic := range joined {
+		msgText += "Topic " + topic.Name + " (member)\n"
+	}
+	bot.Send(tgbotapi.NewMessage(managerID, msgText))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTopicMembership(t *testing.T) {
+	openTestDB(t)
+	topic, err := newTopic("prod-alerts", 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTopic("prod-alerts", 2, false); err == nil {
+		t.Error("created a topic twice")
+	}
+	if _, err := newTopic("Prod Alerts", 2, false); err == nil {
+		t.Error("accepted an invalid topic name")
+	}
+	owner, _ := joinTopic(topic, 1)
+	pending, _ := joinTopic(topic, 2)
+	if !owner.Approved || pending.Approved {
+		t.Errorf("owner approved %v, other chat approved %v", owner.Approved, pending.Approved)
+	}
+	recipients, _ := topicRecipients(topic)
+	if len(recipients) != 1 || recipients[0].ChatID != 1 {
+		t.Errorf("recipients = %+v, want only the owner", recipients)
+	}
+}
+
+func TestPublishToTopic(t *testing.T) {
+	openTestDB(t)
+	config.WebhookAllowedHosts = []string{"ci.example.org"}
+	t.Cleanup(func() { config.WebhookAllowedHosts = nil })
+	topic, _ := newTopic("prod-alerts", 1, false)
+	for _, chatID := range []int64{1, 2, 3} {
+		joinTopic(topic, chatID)
+	}
+	db.Create(&Subscription{ChatID: 1, UUID: "u1", ReceiveMsgs: true, UserName: "oncall"})
+	db.Create(&Subscription{ChatID: 2, UUID: "u2", ReceiveMsgs: true, ThreadID: 5})
+	db.Create(&Subscription{ChatID: 3, UUID: "u3", ReceiveMsgs: false})
+
+	publish := func(token string) *httptest.ResponseRecorder {
+		body := `{"msg": "CPU high", "buttons": [[{"text": "Ack", "callback_data": "ack"}]], "webhook": "https://ci.example.org/hook"}`
+		w, _ := serveTest(handleTopicJSON, http.MethodPost, "/api/topic/:topic/json", "/api/topic/prod-alerts/json", body, http.Header{"Authorization": {"Bearer " + token}})
+		return w
+	}
+	if w := publish("wrong"); w.Code != http.StatusNotFound {
+		t.Errorf("wrong token answered %d", w.Code)
+	}
+	w := publish(topic.PublishToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("publish answered %d: %s", w.Code, w.Body)
+	}
+	var report struct {
+		PublicationID string           `json:"publication_id"`
+		Recipients    []TopicRecipient `json:"recipients"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if len(report.Recipients) != 3 || report.Recipients[0].Name != "@oncall" || report.Recipients[0].Status != deliveryQueued || report.Recipients[2].Error != "not subscribed" {
+		t.Fatalf("report = %+v", report)
+	}
+
+	var deliveries []Delivery
+	db.Preload("Callbacks").Order("id").Find(&deliveries)
+	if len(deliveries) != 2 || deliveries[1].ThreadID != 5 || deliveries[0].PublicationID != report.PublicationID {
+		t.Fatalf("deliveries = %+v", deliveries)
+	}
+	if deliveries[0].Buttons[0][0].CallbackID == deliveries[1].Buttons[0][0].CallbackID || len(deliveries[1].Callbacks) != 1 || deliveries[1].Callbacks[0].ChatID != 2 {
+		t.Errorf("members share callbacks: %+v", deliveries)
+	}
+
+	w, _ = serveTest(handleTopicPublication, http.MethodGet, "/api/topic/:topic/messages/:id", "/api/topic/prod-alerts/messages/"+report.PublicationID+"?token="+topic.PublishToken, "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), deliveries[1].UUID) {
+		t.Errorf("publication report answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestPublishToTopicRejectsIdempotencyKey(t *testing.T) {
+	openTestDB(t)
+	topic, _ := newTopic("prod-alerts", 1, false)
+	joinTopic(topic, 1)
+	db.Create(&Subscription{ChatID: 1, UUID: "u1", ReceiveMsgs: true})
+
+	header := http.Header{"Authorization": {"Bearer " + topic.PublishToken}}
+	if w, _ := serveTest(handleTopicJSON, http.MethodPost, "/api/topic/:topic/json", "/api/topic/prod-alerts/json", `{"msg": "CPU high", "dedup_key": "cpu-1"}`, header); w.Code != http.StatusBadRequest {
+		t.Errorf("dedup_key answered %d", w.Code)
+	}
+	header.Set("Idempotency-Key", "cpu-1")
+	if w, _ := serveTest(handleTopicJSON, http.MethodPost, "/api/topic/:topic/json", "/api/topic/prod-alerts/json", `{"msg": "CPU high"}`, header); w.Code != http.StatusBadRequest {
+		t.Errorf("Idempotency-Key answered %d", w.Code)
+	}
+	var count int64
+	db.Model(&Delivery{}).Count(&count)
+	if count != 0 {
+		t.Errorf("queued %d deliveries", count)
+	}
+}
+
+func TestRegenerateAndDeleteTopic(t *testing.T) {
+	openTestDB(t)
+	topic, _ := newTopic("prod-alerts", 1, false)
+	joinTopic(topic, 1)
+	joinTopic(topic, 2)
+
+	if _, err := regenerateTopicToken(2, "prod-alerts"); err == nil {
+		t.Error("a member regenerated the publish token")
+	}
+	regenerated, err := regenerateTopicToken(1, "prod-alerts")
+	if err != nil || regenerated.PublishToken == topic.PublishToken {
+		t.Fatalf("regenerateTopicToken() = %+v, %v", regenerated, err)
+	}
+	header := http.Header{"Authorization": {"Bearer " + topic.PublishToken}}
+	if w, _ := serveTest(handleTopicJSON, http.MethodPost, "/api/topic/:topic/json", "/api/topic/prod-alerts/json", `{"msg": "CPU high"}`, header); w.Code != http.StatusNotFound {
+		t.Errorf("old token answered %d", w.Code)
+	}
+
+	if err := deleteTopic(2, "prod-alerts"); err == nil {
+		t.Error("a member deleted the topic")
+	}
+	if err := deleteTopic(1, "prod-alerts"); err != nil {
+		t.Fatal(err)
+	}
+	var topics, members int64
+	db.Model(&Topic{}).Count(&topics)
+	db.Model(&TopicMember{}).Count(&members)
+	if topics != 0 || members != 0 {
+		t.Errorf("%d topics and %d members left", topics, members)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// WebhookUser is the Telegram user a webhook event is about.
+type WebhookUser struct {
+	ID        int64  `json:"id"`
+	UserName  string `json:"username,omitempty"`
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+}
+
+func newWebhookUser(user *tgbotapi.User) WebhookUser {
+	if user == nil {
+		return WebhookUser{}
+	}
+	return WebhookUser{ID: user.ID, UserName: user.UserName, FirstName: user.FirstName, LastName: user.LastName}
+}
+
+// displayName is how a user is named in the chat: by username if there is
+// one, by full name otherwise.
+func (u WebhookUser) displayName() string {
+	if u.UserName != "" {
+		return "@" + u.UserName
+	}
+	return strings.TrimSpace(u.FirstName + " " + u.LastName)
+}
+
+// checkWebhookURL validates a webhook given by a client. It has to be http
+// or https and on one of the webhook_allowed_hosts; a "*" entry allows any
+// host. Webhooks are off while the list is empty, so that clients cannot
+// make the server post to internal addresses unless allowed.
+func checkWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an http or https URL")
+	}
+	if len(config.WebhookAllowedHosts) == 0 {
+		return fmt.Errorf("webhooks are disabled on this server")
+	}
+	for _, allowed := range config.WebhookAllowedHosts {
+		if allowed == "*" {
+			return nil
+		}
+	}
+	if !hostInList(u.Hostname(), config.WebhookAllowedHosts) {
+		return fmt.Errorf("host %s is not allowed", u.Hostname())
+	}
+	return nil
+}
+
+// postWebhook posts payload as JSON to webhook. The request is signed like
+// the requests clients send, with the X-Timestamp and X-Signature headers
+// and the signing key of subscription, so the receiver can verify it.
+func postWebhook(webhook string, subscription *Subscription, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(signingKey(subscription)))
+	mac.Write([]byte(timestamp))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, hex.EncodeToString(mac.Sum(nil)))
+
+	client := &http.Client{
+		Timeout: config.WebhookTimeout,
+		// A redirect could lead the signed payload anywhere.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}